@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+)
+
+// The album search only finds what upstream ranks in its first 25 results, which misses albums whose title doesn't
+// name the artist and most of a large catalog. Searches for an artist also resolve the artist on Tidal and go
+// through their whole discography.
+
+// how close an artist's name needs to be to the one asked for
+const artistMinSimilarity = 0.85
+
+// Tidal artist IDs found for names, they don't change
+var artistIds = map[string]string{}
+var artistIdsMutex sync.Mutex
+
+// findArtistId looks up the Tidal artist whose name is closest to artist, unless it's an ID already
+func findArtistId(artist string) (string, error) {
+	if _, err := strconv.ParseUint(artist, 10, 64); err == nil {
+		return artist, nil
+	}
+	artistIdsMutex.Lock()
+	Id, ok := artistIds[artist]
+	artistIdsMutex.Unlock()
+	if ok {
+		return Id, nil
+	}
+	body, err := request("/search/?a=" + url.QueryEscape(artist))
+	if err != nil {
+		return "", err
+	}
+	best := 0.0
+	gjson.Get(body, "data.artists.items").ForEach(func(key, value gjson.Result) bool {
+		//upstream ranks by popularity, so the first of equally close names wins
+		if score := similarity(artist, value.Get("name").String()); score > best {
+			Id, best = value.Get("id").String(), score
+		}
+		return true
+	})
+	if Id == "" || best < artistMinSimilarity {
+		return "", errors.New("not found on Tidal")
+	}
+	artistIdsMutex.Lock()
+	artistIds[artist] = Id
+	artistIdsMutex.Unlock()
+	return Id, nil
+}
+
+// releases per page of a discography, and the most pages read of each kind
+const artistPageSize = 100
+const artistMaxPages = 20
+
+// artistAlbums pages through an artist's albums, then through their EPs and singles, which Tidal lists apart
+func artistAlbums(Id string) ([]Album, error) {
+	var albums []Album
+	seen := map[string]bool{}
+	for _, filter := range []string{"ALBUMS", "EPSANDSINGLES"} {
+		for page := 0; page < artistMaxPages; page++ {
+			body, err := request("/artist/?f=" + url.QueryEscape(Id) + "&skip_tracks=true&filter=" + filter +
+				"&limit=" + strconv.Itoa(artistPageSize) + "&offset=" + strconv.Itoa(page*artistPageSize))
+			if err != nil {
+				if len(albums) > 0 {
+					//keep the pages we have
+					return albums, nil
+				}
+				return nil, err
+			}
+			list := gjson.Get(body, "albums")
+			if !list.Exists() {
+				//some mirror versions wrap it in data
+				list = gjson.Get(body, "data.albums")
+			}
+			added := 0
+			list.Get("items").ForEach(func(key, value gjson.Result) bool {
+				album := parseAlbum(value)
+				if !seen[album.Id] {
+					seen[album.Id] = true
+					albums = append(albums, album)
+					added++
+				}
+				return true
+			})
+			//a mirror ignoring the offset answers the same page again
+			if added == 0 || (page+1)*artistPageSize >= int(list.Get("totalNumberOfItems").Int()) {
+				break
+			}
+		}
+	}
+	return albums, nil
+}
+
+// searchMusic runs the album search and, for an artist, adds their releases from the discography, filtered to
+// those looking like album when that's given. Albums found both ways are listed once.
+func searchMusic(queryUrl string, artist string, album string) ([]Album, error) {
+	albums, err := searchAlbums(queryUrl)
+	if err != nil || strings.TrimSpace(artist) == "" {
+		return albums, err
+	}
+	Id, err := findArtistId(artist)
+	if err != nil {
+		//the album search might still have found it
+		return albums, nil
+	}
+	discography, err := artistAlbums(Id)
+	if err != nil {
+		return albums, nil
+	}
+	seen := map[string]bool{}
+	for _, found := range albums {
+		seen[found.Id] = true
+	}
+	wanted := normalizeName(album)
+	for _, release := range discography {
+		if seen[release.Id] || (wanted != "" && !titleMatches(wanted, release.Title)) {
+			continue
+		}
+		seen[release.Id] = true
+		albums = append(albums, release)
+	}
+	return albums, nil
+}
+
+// titleMatches reports whether a release title is the normalized title asked for, maybe with an edition added
+func titleMatches(wanted string, title string) bool {
+	return strings.Contains(normalizeName(title), wanted) || similarity(wanted, title) >= artistMinSimilarity
+}
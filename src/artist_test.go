@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func discographyAlbums() []fakeAlbum {
+	track := []fakeTrack{{Id: 91, Title: "One", TrackNumber: 1, VolumeNumber: 1, Duration: 1}}
+	return []fakeAlbum{
+		{Id: "3001", Artist: "The Testers", Title: "Green Bar", ReleaseDate: "2021-03-05", Tracks: track},
+		{Id: "3002", Artist: "The Testers", Title: "Deep Cut", ReleaseDate: "2015-06-01", Tracks: track, Unlisted: true},
+		{Id: "3003", Artist: "The Testers", Title: "Deep Cut", Version: "Live", ReleaseDate: "2016-06-01", Tracks: track, Unlisted: true},
+		{Id: "3004", Artist: "The Testers Tribute Band", ArtistId: "700", Title: "Cover Versions", ReleaseDate: "2020-01-01", Tracks: track},
+	}
+}
+
+func TestMusicSearchFindsAlbumsInTheDiscography(t *testing.T) {
+	proxy := newTestProxy(t, "flac", discographyAlbums()...)
+	useRssFeed(t, false)
+
+	rss := proxy.search(t, url.Values{"t": {"music"}, "artist": {"The Testers"}, "album": {"Deep Cut"}})
+	var ids []string
+	for _, item := range rss.Channel.Items {
+		ids = append(ids, item.Guid.Value[strings.LastIndex(item.Guid.Value, "=")+1:])
+	}
+	if strings.Join(ids, ",") != "3002,3003" {
+		t.Errorf("expected both Deep Cut releases from the discography, got %v", ids)
+	}
+
+	// without an album, the whole discography, with albums the search found too listed once
+	rss = proxy.search(t, url.Values{"t": {"music"}, "artist": {"the testers"}})
+	seen := map[string]int{}
+	for _, item := range rss.Channel.Items {
+		seen[item.Guid.Value]++
+	}
+	for _, Id := range []string{"3001", "3002", "3003"} {
+		if seen["http://www.tidal.com/album?id="+Id] != 1 {
+			t.Errorf("expected album %s once, got %v", Id, seen)
+		}
+	}
+}
+
+func TestDiscographyPagesThroughLargeCatalog(t *testing.T) {
+	track := discographyAlbums()[0].Tracks
+	var albums []fakeAlbum
+	for i := 0; i < 2*artistPageSize+10; i++ {
+		albums = append(albums, fakeAlbum{Id: strconv.Itoa(4000 + i), Artist: "The Testers", Title: "Take " + strconv.Itoa(i), ReleaseDate: "2010-01-01", Tracks: track, Unlisted: true})
+	}
+	albums = append(albums, fakeAlbum{Id: "3999", Artist: "The Testers", Title: "Single Bar", ReleaseDate: "2011-01-01", Tracks: track, Unlisted: true, Single: true})
+	proxy := newTestProxy(t, "flac", albums...)
+	useRssFeed(t, false)
+
+	discography, err := artistAlbums("500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(discography) != len(albums) {
+		t.Errorf("expected all %d releases, got %d", len(albums), len(discography))
+	}
+	if hits := proxy.Upstream.Hits("/artist/"); hits != 4 {
+		t.Errorf("expected three pages of albums and one of singles, upstream saw %d", hits)
+	}
+	findItem(t, proxy.search(t, url.Values{"t": {"music"}, "artist": {"The Testers"}, "album": {"Take 205"}}), "Take 205")
+	findItem(t, proxy.search(t, url.Values{"t": {"music"}, "artist": {"The Testers"}, "album": {"Single Bar"}}), "Single Bar")
+}
+
+func TestDiscographyReleaseWithoutDate(t *testing.T) {
+	albums := append(discographyAlbums(), fakeAlbum{Id: "3005", Artist: "The Testers", Title: "Demo Tape", Tracks: discographyAlbums()[0].Tracks, Unlisted: true})
+	proxy := newTestProxy(t, "flac", albums...)
+	useRssFeed(t, false)
+	item := findItem(t, proxy.search(t, url.Values{"t": {"music"}, "artist": {"The Testers"}}), "Demo Tape")
+	if !strings.HasSuffix(item.Title, "-WEB-FLAC-TIDLARR") {
+		t.Errorf("expected a name without a year, got %s", item.Title)
+	}
+}
+
+func TestFindArtistIdNeedsACloseName(t *testing.T) {
+	newTestProxy(t, "flac", discographyAlbums()...)
+	useRssFeed(t, false)
+	if Id, err := findArtistId("The Tester Tribute Band"); err != nil || Id != "700" {
+		t.Errorf("expected the tribute band, got %q, %v", Id, err)
+	}
+	if Id, err := findArtistId("Testers"); err == nil {
+		t.Errorf("a partial name shouldn't resolve, got %q", Id)
+	}
+}
+
+func TestCapsAdvertiseMusicSearch(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	if body := proxy.get(t, "/indexer", url.Values{"t": {"caps"}}); !strings.Contains(body, `<music-search available="yes" supportedParams="q,artist,album"/>`) {
+		t.Errorf("music search isn't advertised: %s", body)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cavaliergopher/grab/v3"
+)
+
+// All track and cover transfers share one bandwidth limit. It's set with SPEED_LIMIT or at runtime through
+// SABnzbd's mode=config&name=speedlimit, either absolute ("500K", "2M") or as a percentage of BANDWIDTH_MAX ("50").
+// SPEED_SCHEDULE changes it at given times of day, like "07:00=500K,23:00=100": a manual change holds until the next
+// scheduled one.
+
+// BandwidthMax is the line speed percentages refer to, in bytes per second. 0 if unknown.
+var BandwidthMax int64
+
+type speedChange struct {
+	minute int // of the day
+	limit  int64
+}
+
+var speedLimit struct {
+	sync.Mutex
+	manual   int64
+	manualAt time.Time
+	schedule []speedChange
+}
+
+func setupBandwidth() {
+	var err error
+	if line := getEnv("BANDWIDTH_MAX", ""); line != "" {
+		if BandwidthMax, err = parseSpeed(line); err != nil {
+			exitWithError("Invalid BANDWIDTH_MAX", err)
+		}
+	}
+	limit, err := parseSpeedLimit(getEnv("SPEED_LIMIT", "0"))
+	if err != nil {
+		exitWithError("Invalid SPEED_LIMIT", err)
+	}
+	schedule, err := parseSpeedSchedule(getEnv("SPEED_SCHEDULE", ""))
+	if err != nil {
+		exitWithError("Invalid SPEED_SCHEDULE", err)
+	}
+	speedLimit.Lock()
+	//set before any scheduled change, so the schedule wins from the start
+	speedLimit.manual, speedLimit.manualAt = limit, time.Time{}
+	speedLimit.schedule = schedule
+	speedLimit.Unlock()
+	if limit > 0 || len(schedule) > 0 {
+		slog.Info("Bandwidth limited", "speed_limit", limit, "schedule", len(schedule))
+	}
+}
+
+// parseSpeed reads an absolute speed like "500K", "2M" or "2MB", in bytes per second
+func parseSpeed(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if strings.HasSuffix(value, "K") || strings.HasSuffix(value, "M") || strings.HasSuffix(value, "G") {
+		value += "B"
+	}
+	return parseSize(value)
+}
+
+// parseSpeedLimit reads a limit the way SABnzbd does: a bare number or "%" is a percentage of BandwidthMax, a number
+// with a unit is absolute. 0 means no limit, and so does 100%.
+func parseSpeedLimit(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.EqualFold(value, "none") {
+		return 0, nil
+	}
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil {
+		return parseSpeed(value)
+	}
+	if percent <= 0 || percent >= 100 {
+		return 0, nil
+	}
+	if BandwidthMax == 0 {
+		return 0, errors.New("a percentage needs BANDWIDTH_MAX to be set, or give a speed like 500K")
+	}
+	return int64(float64(BandwidthMax) * percent / 100), nil
+}
+
+// parseSpeedSchedule reads "HH:MM=limit" entries separated by commas
+func parseSpeedSchedule(value string) ([]speedChange, error) {
+	var schedule []speedChange
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		at, limit, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q isn't HH:MM=limit", entry)
+		}
+		clock, err := time.Parse("15:04", strings.TrimSpace(at))
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't HH:MM=limit", entry)
+		}
+		bytes, err := parseSpeedLimit(limit)
+		if err != nil {
+			return nil, err
+		}
+		schedule = append(schedule, speedChange{minute: clock.Hour()*60 + clock.Minute(), limit: bytes})
+	}
+	sort.Slice(schedule, func(i, j int) bool { return schedule[i].minute < schedule[j].minute })
+	return schedule, nil
+}
+
+// currentSpeedLimit is the limit in force at now, in bytes per second, 0 for none
+func currentSpeedLimit(now time.Time) int64 {
+	speedLimit.Lock()
+	defer speedLimit.Unlock()
+	if len(speedLimit.schedule) == 0 {
+		return speedLimit.manual
+	}
+	//the last change that already happened, today or else yesterday
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	last := speedLimit.schedule[len(speedLimit.schedule)-1]
+	lastAt := midnight.AddDate(0, 0, -1).Add(time.Duration(last.minute) * time.Minute)
+	for _, change := range speedLimit.schedule {
+		at := midnight.Add(time.Duration(change.minute) * time.Minute)
+		if at.After(now) {
+			break
+		}
+		last, lastAt = change, at
+	}
+	if speedLimit.manualAt.After(lastAt) {
+		return speedLimit.manual
+	}
+	return last.limit
+}
+
+// setSpeedLimit changes the limit until the next scheduled change
+func setSpeedLimit(limit int64) {
+	speedLimit.Lock()
+	defer speedLimit.Unlock()
+	speedLimit.manual, speedLimit.manualAt = limit, time.Now()
+}
+
+// bandwidthLimiter paces every transfer against the one shared limit. Each read reserves its share of the time
+// line, so concurrent transfers split the bandwidth between them.
+type bandwidthLimiter struct {
+	mu   sync.Mutex
+	next time.Time
+}
+
+var downloadLimiter = &bandwidthLimiter{}
+
+func (l *bandwidthLimiter) WaitN(ctx context.Context, n int) error {
+	limit := currentSpeedLimit(time.Now())
+	if limit <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	//unused bandwidth only carries over for a second
+	if l.next.Before(now.Add(-time.Second)) {
+		l.next = now.Add(-time.Second)
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / float64(limit) * float64(time.Second)))
+	wait := l.next.Sub(now)
+	l.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fetchFile downloads url to path through the bandwidth limit
+func fetchFile(path string, url string) (*grab.Response, error) {
+	req, err := grab.NewRequest(path, url)
+	if err != nil {
+		return nil, err
+	}
+	req.RateLimiter = downloadLimiter
+	resp := grab.DefaultClient.Do(req)
+	return resp, resp.Err()
+}
+
+// speedLimitFields reports the limit like SABnzbd's queue: a percentage of BandwidthMax and bytes per second
+func speedLimitFields() (percent string, absolute string) {
+	limit := currentSpeedLimit(time.Now())
+	if limit <= 0 {
+		return "100", ""
+	}
+	percent = "100"
+	if BandwidthMax > 0 {
+		percent = strconv.FormatInt(min(100, limit*100/BandwidthMax), 10)
+	}
+	return percent, strconv.FormatInt(limit, 10)
+}
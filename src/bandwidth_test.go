@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useBandwidth sets the line speed and starts without a limit or schedule, restoring both after the test
+func useBandwidth(t *testing.T, line int64) {
+	t.Helper()
+	oldMax := BandwidthMax
+	speedLimit.Lock()
+	oldManual, oldManualAt, oldSchedule := speedLimit.manual, speedLimit.manualAt, speedLimit.schedule
+	speedLimit.manual, speedLimit.manualAt, speedLimit.schedule = 0, time.Time{}, nil
+	speedLimit.Unlock()
+	t.Cleanup(func() {
+		BandwidthMax = oldMax
+		speedLimit.Lock()
+		speedLimit.manual, speedLimit.manualAt, speedLimit.schedule = oldManual, oldManualAt, oldSchedule
+		speedLimit.Unlock()
+	})
+	BandwidthMax = line
+}
+
+func TestParseSpeedLimit(t *testing.T) {
+	useBandwidth(t, 10<<20)
+	cases := map[string]int64{
+		"":      0,
+		"0":     0,
+		"100":   0,
+		"50":    5 << 20,
+		"25%":   10 << 20 / 4,
+		"500K":  500 << 10,
+		"500KB": 500 << 10,
+		"2m":    2 << 20,
+	}
+	for value, want := range cases {
+		if got, err := parseSpeedLimit(value); err != nil || got != want {
+			t.Errorf("parseSpeedLimit(%q) = %d, %v, want %d", value, got, err, want)
+		}
+	}
+	if _, err := parseSpeedLimit("fast"); err == nil {
+		t.Error("nonsense should be rejected")
+	}
+	BandwidthMax = 0
+	if _, err := parseSpeedLimit("50"); err == nil {
+		t.Error("a percentage without BANDWIDTH_MAX should be rejected")
+	}
+}
+
+func TestSpeedSchedule(t *testing.T) {
+	useBandwidth(t, 0)
+	schedule, err := parseSpeedSchedule("23:00=0, 07:00=500K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	speedLimit.schedule = schedule
+	day := func(hour int) time.Time { return time.Date(2024, 5, 1, hour, 0, 0, 0, time.Local) }
+	if limit := currentSpeedLimit(day(12)); limit != 500<<10 {
+		t.Errorf("daytime limit = %d", limit)
+	}
+	if limit := currentSpeedLimit(day(2)); limit != 0 {
+		t.Errorf("after midnight should still be the 23:00 setting, got %d", limit)
+	}
+
+	// a manual change holds until the next scheduled one
+	setSpeedLimit(100 << 10)
+	now := time.Now()
+	if limit := currentSpeedLimit(now); limit != 100<<10 {
+		t.Errorf("manual limit not applied: %d", limit)
+	}
+	if limit := currentSpeedLimit(now.Add(24 * time.Hour)); limit == 100<<10 {
+		t.Error("manual limit should give way to the schedule")
+	}
+
+	for _, bad := range []string{"7=500K", "25:00=1M", "07:00"} {
+		if _, err := parseSpeedSchedule(bad); err == nil {
+			t.Errorf("%q should be rejected", bad)
+		}
+	}
+}
+
+func TestFetchFileIsThrottled(t *testing.T) {
+	useBandwidth(t, 0)
+	data := bytes.Repeat([]byte("x"), 800<<10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer server.Close()
+	setSpeedLimit(400 << 10)
+
+	// the first second's worth comes at once, the rest at the limit
+	start := time.Now()
+	if _, err := fetchFile(filepath.Join(t.TempDir(), "file"), server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 700*time.Millisecond {
+		t.Errorf("800K at 400K/s took only %v", elapsed)
+	}
+
+	setSpeedLimit(0)
+	start = time.Now()
+	if _, err := fetchFile(filepath.Join(t.TempDir(), "file"), server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("unlimited transfer took %v", elapsed)
+	}
+}
+
+func TestSpeedLimitApi(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	useBandwidth(t, 10<<20)
+	if queue := proxy.queue(t); queue.Queue.SpeedLimit != "100" || queue.Queue.SpeedLimitAbs != "" {
+		t.Errorf("no limit should be reported as 100%%, got %+v", queue.Queue)
+	}
+
+	body := proxy.get(t, "/downloader/api", url.Values{"mode": {"config"}, "name": {"speedlimit"}, "value": {"40"}})
+	if !strings.Contains(body, `"status":true`) {
+		t.Errorf("speedlimit should be accepted, got %s", body)
+	}
+	if queue := proxy.queue(t); queue.Queue.SpeedLimit != "40" || queue.Queue.SpeedLimitAbs != "4194304" {
+		t.Errorf("queue should report the new limit, got %+v", queue.Queue)
+	}
+
+	if status, _ := proxy.getStatus(t, "/downloader/api", url.Values{"mode": {"config"}, "name": {"speedlimit"}, "value": {"fast"}}); status != http.StatusBadRequest {
+		t.Errorf("an invalid limit should be rejected, got %d", status)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Before an album starts, its estimated size has to fit on DOWNLOAD_PATH while leaving MIN_FREE_SPACE free, and within
+// COMPLETE_QUOTA if one is set. Until it does the job waits as Paused. Lidarr importing albums out of complete/
+// usually makes room again. Free space is checked again before every track, in case something else fills the disk.
+
+// CompleteQuota caps the total size of the complete folder, 0 for no cap
+var CompleteQuota int64
+var diskCheckInterval = 30 * time.Second
+
+// diskSpaceOf is diskSpace, swapped in tests
+var diskSpaceOf = diskSpace
+
+var completeSizeCache struct {
+	sync.Mutex
+	size    int64
+	checked time.Time
+}
+
+func setupDiskQuota() {
+	var err error
+	CompleteQuota, err = parseSize(getEnv("COMPLETE_QUOTA", "0"))
+	if err != nil {
+		exitWithError("Invalid COMPLETE_QUOTA", err)
+	}
+}
+
+// completeSize is the size of the complete folder, walked at most every 10 seconds
+func completeSize() int64 {
+	completeSizeCache.Lock()
+	defer completeSizeCache.Unlock()
+	if time.Since(completeSizeCache.checked) > 10*time.Second {
+		completeSizeCache.size, _ = folderSize(filepath.Join(DownloadPath, "complete", Category))
+		completeSizeCache.checked = time.Now()
+	}
+	return completeSizeCache.size
+}
+
+func forgetCompleteSize() {
+	completeSizeCache.Lock()
+	defer completeSizeCache.Unlock()
+	completeSizeCache.checked = time.Time{}
+}
+
+// availableSpace is the space downloads can use: what's free on the disk, or left of the quota if that's less
+func availableSpace() (free int64, total int64, err error) {
+	diskFree, diskTotal, err := diskSpaceOf(DownloadPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	free, total = int64(diskFree), int64(diskTotal)
+	if CompleteQuota > 0 {
+		free = min(free, max(CompleteQuota-completeSize(), 0))
+		total = min(total, CompleteQuota)
+	}
+	return free, total, nil
+}
+
+// diskSpaceProblem explains why an album of need bytes can't be downloaded right now, empty if it can
+func diskSpaceProblem(need int64) string {
+	diskFree, _, err := diskSpaceOf(DownloadPath)
+	if err != nil {
+		return "can't read free space: " + err.Error()
+	}
+	if int64(diskFree)-need < MinFreeSpace {
+		return fmt.Sprintf("%d MB free on the download disk, %d MB needed plus %d MB to keep free", diskFree>>20, need>>20, MinFreeSpace>>20)
+	}
+	if CompleteQuota > 0 && completeSize()+need > CompleteQuota {
+		return fmt.Sprintf("complete folder holds %d MB of its %d MB quota, %d MB needed", completeSize()>>20, CompleteQuota>>20, need>>20)
+	}
+	return ""
+}
+
+// albumSize estimates what a fetched album takes up on disk while it downloads
+func albumSize(download Download) int64 {
+	var duration int64
+	for _, track := range download.Files {
+		duration += int64(track.duration)
+	}
+	return estimateSize(Album{Duration: duration, SamplingRate: 44, BitDepth: 16, Channels: 2}, nil)
+}
+
+// waitForDiskSpace holds a job as Paused until need bytes fit. Fails right away if they never could.
+func waitForDiskSpace(download *Download, need int64) error {
+	if CompleteQuota > 0 && need > CompleteQuota {
+		return fmt.Errorf("album needs about %d MB, more than the %d MB COMPLETE_QUOTA", need>>20, CompleteQuota>>20)
+	}
+	if _, total, err := diskSpaceOf(DownloadPath); err == nil && need > int64(total) {
+		return errors.New("album is larger than the download disk")
+	}
+	DownloadsMutex.Lock()
+	status := download.Status
+	DownloadsMutex.Unlock()
+	paused := false
+	for problem := diskSpaceProblem(need); problem != ""; problem = diskSpaceProblem(need) {
+		if stopping.Load() {
+			setStatus(download, status)
+			return errInterrupted
+		}
+		if !paused {
+			slog.Warn("Not enough disk space, pausing", "nzo_id", "SABnzbd_nzo_"+download.Id, "reason", problem)
+			addWarning("SABnzbd_nzo_"+download.Id, "Not enough disk space, pausing "+download.FileName+": "+problem)
+			setStatus(download, StatusPaused)
+			paused = true
+		}
+		select {
+		case <-stopSignal():
+		case <-time.After(diskCheckInterval):
+		}
+		forgetCompleteSize()
+	}
+	if paused {
+		slog.Info("Disk space available again, resuming", "nzo_id", "SABnzbd_nzo_"+download.Id)
+		setStatus(download, status)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDisk replaces the free space check with a disk of total bytes, of which free can be changed while running
+func fakeDisk(t *testing.T, free int64, total int64) *atomic.Int64 {
+	t.Helper()
+	var current atomic.Int64
+	current.Store(free)
+	oldDiskSpace, oldInterval, oldMinFree, oldQuota := diskSpaceOf, diskCheckInterval, MinFreeSpace, CompleteQuota
+	t.Cleanup(func() {
+		diskSpaceOf, diskCheckInterval, MinFreeSpace, CompleteQuota = oldDiskSpace, oldInterval, oldMinFree, oldQuota
+		forgetCompleteSize()
+	})
+	diskSpaceOf = func(path string) (uint64, uint64, error) {
+		return uint64(current.Load()), uint64(total), nil
+	}
+	diskCheckInterval = 20 * time.Millisecond
+	forgetCompleteSize()
+	return &current
+}
+
+func waitForStatus(t *testing.T, proxy *testProxy, status string) QueueResponse {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		queue := proxy.queue(t)
+		for _, slot := range queue.Queue.Slots {
+			if slot.Status == status {
+				return queue
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("no job became %s", status)
+	return QueueResponse{}
+}
+
+func TestQueuePausesWithoutDiskSpace(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	free := fakeDisk(t, 100<<20, 1<<30)
+	MinFreeSpace = 500 << 20
+
+	nzoId := proxy.grab(t, findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Red Bar"}}), "Red Bar"))
+	queue := waitForStatus(t, proxy, StatusPaused)
+	if !queue.Queue.Paused || queue.Queue.Diskspace1 != "0.10" || queue.Queue.Diskspacetotal1 != "1.00" {
+		t.Errorf("queue should report the pause and the free space: %+v", queue.Queue)
+	}
+
+	free.Store(800 << 20)
+	if slot := proxy.waitForHistory(t, nzoId); slot.Status != "Completed" {
+		t.Errorf("download should resume once there's space: %+v", slot)
+	}
+	if queue := proxy.queue(t); queue.Queue.Paused {
+		t.Errorf("queue still paused: %+v", queue.Queue)
+	}
+}
+
+func TestCompleteQuota(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	fakeDisk(t, 100<<30, 200<<30)
+	// an earlier album already fills most of the quota
+	CompleteQuota = 1 << 20
+	old := filepath.Join(DownloadPath, "complete", Category, "Earlier-TIDLARR")
+	os.MkdirAll(old, 0755)
+	os.WriteFile(filepath.Join(old, "01.flac"), make([]byte, 1<<20-1000), 0644)
+
+	nzoId := proxy.grab(t, findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Red Bar"}}), "Red Bar"))
+	queue := waitForStatus(t, proxy, StatusPaused)
+	if queue.Queue.Diskspacetotal1 != "0.00" || queue.Queue.Diskspace1 != "0.00" {
+		t.Errorf("queue should report the quota, got %+v", queue.Queue)
+	}
+
+	// Lidarr imports the earlier album
+	os.RemoveAll(old)
+	if slot := proxy.waitForHistory(t, nzoId); slot.Status != "Completed" {
+		t.Errorf("download should resume once the quota has room: %+v", slot)
+	}
+}
+
+func TestAlbumLargerThanQuotaFails(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	fakeDisk(t, 100<<30, 200<<30)
+	CompleteQuota = 1000
+	nzoId := proxy.grab(t, findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Red Bar"}}), "Red Bar"))
+	slot := proxy.waitForHistory(t, nzoId)
+	if slot.Status != "Failed" || !strings.Contains(slot.FailMessage, "COMPLETE_QUOTA") {
+		t.Errorf("an album that can never fit should fail, got %+v", slot)
+	}
+}
+
+func TestConfigReportsPreCheck(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	if body := proxy.get(t, "/downloader/api", url.Values{"mode": {"get_config"}}); !strings.Contains(body, `"pre_check":true`) {
+		t.Errorf("pre_check should be on, got %s", body)
+	}
+}
+
+func TestPausedJobStopsWithShutdown(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	resetStopping(t)
+	fakeDisk(t, 100<<20, 1<<30)
+	MinFreeSpace = 500 << 20
+	diskCheckInterval = time.Hour
+
+	proxy.grab(t, findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Red Bar"}}), "Red Bar"))
+	waitForStatus(t, proxy, StatusPaused)
+	start := time.Now()
+	if !drainWorkers(5 * time.Second) {
+		t.Fatal("paused job outlasted the shutdown grace")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("paused job took %v to stop", time.Since(start))
+	}
+}
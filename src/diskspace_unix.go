@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// diskSpace returns the free and total bytes of the filesystem holding path
+func diskSpace(path string) (free uint64, total uint64, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), uint64(stat.Blocks) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// diskSpace returns the free and total bytes of the filesystem holding path
+func diskSpace(path string) (free uint64, total uint64, err error) {
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	ok, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(&free)), uintptr(unsafe.Pointer(&total)), 0)
+	if ok == 0 {
+		return 0, 0, err
+	}
+	return free, total, nil
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
@@ -12,8 +14,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/cavaliergopher/grab/v3"
 	"github.com/tidwall/gjson"
 	"go.senan.xyz/taglib"
 )
@@ -46,29 +48,48 @@ type ConfigResponse struct {
 }
 
 type File struct {
-	Id           int
-	Name         string
-	Index        string
-	mediaNumber  string
-	isrc         string
-	DownloadLink string
-	completed    bool
-	Lyrics       string
+	Id          int
+	Name        string
+	Index       string
+	mediaNumber string
+	isrc        string
+	duration    int
+	// loudness reported by Tidal, album values only come with the track manifest
+	replayGain      float64
+	peak            float64
+	albumReplayGain float64
+	albumPeak       float64
+	DownloadLink    string
+	// file path within the album folder, without extension
+	path      string
+	completed bool
+	Lyrics    string
 }
 
 type Download struct {
-	Id         string
-	Artist     string
-	Album      string
-	Comment    string
-	CoverUrl   string
-	numTracks  int
-	mediaCount int
-	label      string
-	downloaded int
-	FileName   string
-	Files      []File
-	hasLyrics  bool
+	Id          string
+	Artist      string
+	Album       string
+	Comment     string
+	CoverUrl    string
+	numTracks   int
+	mediaCount  int
+	label       string
+	year        string
+	downloaded  int
+	FileName    string
+	Files       []File
+	hasLyrics   bool
+	Status      string
+	FailMessage string
+	// output of the post-processing scripts
+	scriptLog string
+	// how Lidarr's import went, when it's asked to import
+	importStatus  string
+	importMessage string
+	added         time.Time
+	// track IDs already downloaded before a restart
+	resumeTracks map[int]bool
 }
 
 var Downloads map[string]*Download = make(map[string]*Download)
@@ -76,7 +97,7 @@ var Downloads map[string]*Download = make(map[string]*Download)
 func handleDownloaderRequest(w http.ResponseWriter, r *http.Request) {
 	var queryApiKey string = r.URL.Query().Get("apikey")
 	if ApiKey != queryApiKey {
-		w.Write([]byte("error: API Key Incorrect"))
+		sabError(w, http.StatusForbidden, "API Key Incorrect")
 		return
 	}
 	switch query := r.URL.Query().Get("mode"); query {
@@ -85,30 +106,45 @@ func handleDownloaderRequest(w http.ResponseWriter, r *http.Request) {
 	case "version":
 		version(w, *r.URL)
 	case "addurl":
-		addurl(w, *r.URL)
+		addurl(w, r)
 	case "addfile":
 		addfile(w, r)
 	case "queue":
 		queue(w, r)
 	case "history":
 		history(w, r)
+	case "config":
+		config(w, r)
+	case "fullstatus":
+		fullstatus(w, r)
+	case "server_stats":
+		server_stats(w, r)
+	case "warnings":
+		warnings(w, r)
+	case "get_cats":
+		get_cats(w, r)
 	default:
-		fmt.Println("Downloader unknown request:")
-		fmt.Println(r.Method)
-		fmt.Println(r.URL.String())
-		fmt.Println(r.Header)
-		buffer := make([]byte, 100)
-		for {
-			n, err := r.Body.Read(buffer)
-			fmt.Printf("%q\n", buffer[:n])
-			if err == io.EOF {
-				break
-			}
-		}
-		w.Write([]byte("Request received!"))
+		slog.WarnContext(r.Context(), "Downloader unknown request", "method", r.Method, "url", redactUrl(r.URL), "user_agent", r.UserAgent())
+		sabError(w, http.StatusNotImplemented, "not implemented")
 	}
 }
 
+// sabError answers like SABnzbd does when a call fails, so Lidarr reports the error instead of waiting for a job that doesn't exist
+func sabError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": false,
+		"error":  message,
+	})
+}
+
+// validTidalId reports whether an ID taken from an nzb looks like a Tidal album ID
+func validTidalId(Id string) bool {
+	_, err := strconv.ParseUint(Id, 10, 64)
+	return err == nil
+}
+
 func get_config(w http.ResponseWriter, u url.URL) {
 	resp := ConfigResponse{
 		Config: Config{
@@ -116,7 +152,7 @@ func get_config(w http.ResponseWriter, u url.URL) {
 				CompleteDir:            filepath.Join(DownloadPath, "complete"),
 				EnableTVSorting:        false,
 				EnableMovieSorting:     false,
-				PreCheck:               false,
+				PreCheck:               true,
 				HistoryRetention:       "",
 				HistoryRetentionOption: "all",
 			},
@@ -124,7 +160,7 @@ func get_config(w http.ResponseWriter, u url.URL) {
 				{
 					Name:     "music",
 					Pp:       "",
-					Script:   "Default",
+					Script:   scriptName(),
 					Dir:      filepath.Join(DownloadPath, "incomplete", "music"),
 					Priority: -100,
 				},
@@ -133,97 +169,144 @@ func get_config(w http.ResponseWriter, u url.URL) {
 		},
 	}
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		fmt.Println("Error encoding JSON:", err)
+		slog.Error("Error encoding JSON", "error", err)
+	}
+}
+
+// config changes settings at runtime. Only the speed limit is supported.
+func config(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("name") != "speedlimit" {
+		sabError(w, http.StatusNotImplemented, "not implemented")
+		return
 	}
+	limit, err := parseSpeedLimit(r.URL.Query().Get("value"))
+	if err != nil {
+		sabError(w, http.StatusBadRequest, "Invalid speed limit: "+err.Error())
+		return
+	}
+	setSpeedLimit(limit)
+	slog.InfoContext(r.Context(), "Speed limit changed", "speed_limit", limit)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"status": true})
 }
 
+// the SABnzbd version we answer as
+const sabVersion = "4.5.1"
+
 func version(w http.ResponseWriter, u url.URL) {
 	w.Write([]byte(`{
- 	    "version": "4.5.1"
+ 	    "version": "` + sabVersion + `"
  	}`))
 }
 
-func addurl(w http.ResponseWriter, u url.URL) {
+func addurl(w http.ResponseWriter, r *http.Request) {
+	u := r.URL
 	//Grab the URL Parameter from the URL
 	rawUrl, _ := url.QueryUnescape(u.Query().Get("name"))
-	parsedUrl, _ := url.Parse(rawUrl)
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		sabError(w, http.StatusBadRequest, "Invalid URL: "+err.Error())
+		return
+	}
 	//Parse Name, ID and number of tracks
 	filename := parsedUrl.Query().Get("name")
 	filename = sanitizeFilename(filename)
 	Id := parsedUrl.Query().Get("tidalid")
+	if filename == "" || !validTidalId(Id) {
+		sabError(w, http.StatusBadRequest, "URL is not a tidlarr nzb link")
+		return
+	}
 	NumTracks, _ := strconv.Atoi(parsedUrl.Query().Get("numtracks"))
-	generateDownload(filename, Id, NumTracks)
+	if stopping.Load() {
+		sabError(w, http.StatusServiceUnavailable, "Shutting down, not accepting new downloads")
+		return
+	}
+	slog.InfoContext(r.Context(), "Grab received", "nzo_id", "SABnzbd_nzo_"+Id, "album_id", Id, "name", filename, "via", "addurl")
+	queueDownload(filename, Id, NumTracks)
 	//send response using TidalId as nzo_id
 	w.Write([]byte("{\n" +
 		"\"status\": true,\n" +
 		"\"nzo_ids\": [\"SABnzbd_nzo_" + Id + "\"]\n" +
 		"}"))
-	if download, ok := Downloads[Id]; ok && download.downloaded != -1 {
-		go startDownload(Id)
-	}
 }
 
 func addfile(w http.ResponseWriter, r *http.Request) {
 	//extract filename, TidalId and number of tracks
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		fmt.Println("/downloader/api/addfile Failed to read body:")
-		fmt.Println(err)
+		slog.ErrorContext(r.Context(), "addfile failed to read body", "error", err)
+		sabError(w, http.StatusBadRequest, "Failed to read nzb: "+err.Error())
+		return
 	}
 	reNum := regexp.MustCompile("[a-zA-Z0-9]+")
 	reName := regexp.MustCompile("filename=.*.nzb")
 	var lines []string = strings.Split(string(body), "\n")
+	if len(lines) < 8 {
+		sabError(w, http.StatusBadRequest, "Not a tidlarr nzb")
+		return
+	}
 	var filename string = reName.FindString(lines[1])
 	filename = strings.Trim(filename, "filename=\"")
 	filename = strings.TrimRight(filename, ".nzb")
 	filename = sanitizeFilename(filename)
 	var Id = reNum.FindString(lines[6])
-	fmt.Println(filename)
+	if filename == "" || !validTidalId(Id) {
+		sabError(w, http.StatusBadRequest, "Not a tidlarr nzb")
+		return
+	}
 	var NumTracks, _ = strconv.Atoi(reNum.FindString(lines[7]))
-	generateDownload(filename, Id, NumTracks)
+	if stopping.Load() {
+		sabError(w, http.StatusServiceUnavailable, "Shutting down, not accepting new downloads")
+		return
+	}
+	slog.InfoContext(r.Context(), "Grab received", "nzo_id", "SABnzbd_nzo_"+Id, "album_id", Id, "name", filename, "via", "addfile")
+	queueDownload(filename, Id, NumTracks)
 	//send response using TidalId as nzo_id
 	w.Write([]byte("{\n" +
 		"\"status\": true,\n" +
 		"\"nzo_ids\": [\"SABnzbd_nzo_" + Id + "\"]\n" +
 		"}"))
-	if download, ok := Downloads[Id]; ok && download.downloaded != -1 {
-		go startDownload(Id)
-	}
 }
 
-func generateDownload(filename string, Id string, numTracks int) {
-	var download Download
-	download.Id = Id
-	download.numTracks = numTracks
-	download.FileName = filename
-	download.downloaded = 0
-	download.hasLyrics = true
-
-	var queryUrl string = "/album?id=" + Id
+// fetchAlbum resolves the album metadata and tracklist. Track manifests are resolved later, right before each track
+// downloads, so their signed URLs are still fresh.
+func fetchAlbum(download *Download) error {
+	var queryUrl string = "/album?id=" + download.Id
 	bodyBytes, err := request(queryUrl)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
+	if !gjson.Get(bodyBytes, "data.items.0").Exists() {
+		return errors.New("album " + download.Id + " has no tracks")
+	}
+
+	DownloadsMutex.Lock()
+	defer DownloadsMutex.Unlock()
 	download.Artist = gjson.Get(bodyBytes, "data.items.0.item.artist.name").String()
 	download.Album = gjson.Get(bodyBytes, "data.items.0.item.album.title").String()
-	fmt.Println("Artist: " + download.Artist)
-	fmt.Println("Album: " + download.Album)
+	slog.Info("Fetched album", "nzo_id", "SABnzbd_nzo_"+download.Id, "album_id", download.Id, "artist", download.Artist, "album", download.Album)
 	if download.Comment == "null" {
 		download.Comment = ""
 	}
 	download.numTracks = int(gjson.Get(bodyBytes, "data.items.#").Int())
 	download.mediaCount = 1
-	for _, volume := range gjson.Get(bodyBytes, "data.items.#.volumeNumber").Array() {
+	for _, volume := range gjson.Get(bodyBytes, "data.items.#.item.volumeNumber").Array() {
 		if download.mediaCount < int(volume.Int()) {
 			download.mediaCount = int(volume.Int())
 		}
 	}
 	download.label = gjson.Get(bodyBytes, "data.items.0.item.copyright").String()
+	for _, date := range []string{"data.releaseDate", "data.items.0.item.album.releaseDate", "data.items.0.item.streamStartDate"} {
+		if value := gjson.Get(bodyBytes, date).String(); len(value) >= 4 {
+			download.year = value[0:4]
+			break
+		}
+	}
 	download.CoverUrl = gjson.Get(bodyBytes, "data.items.0.item.album.cover").String()
 	re := regexp.MustCompile(`-`)
 	download.CoverUrl = re.ReplaceAllString(download.CoverUrl, "/")
-	download.CoverUrl = "https://resources.tidal.com/images/" + download.CoverUrl + "/1280x1280.jpg"
+	download.CoverUrl = ImageHost + "/images/" + download.CoverUrl + "/1280x1280.jpg"
+	download.Files = nil
 	result := gjson.Get(bodyBytes, "data.items")
 	result.ForEach(func(key, value gjson.Result) bool {
 		var track File
@@ -233,22 +316,41 @@ func generateDownload(filename string, Id string, numTracks int) {
 		track.Index = gjson.Get(valueString, "item.trackNumber").String()
 		track.mediaNumber = gjson.Get(valueString, "item.volumeNumber").String()
 		track.isrc = gjson.Get(valueString, "item.isrc").String()
+		track.duration = int(gjson.Get(valueString, "item.duration").Int())
+		track.replayGain = gjson.Get(valueString, "item.replayGain").Float()
+		track.peak = gjson.Get(valueString, "item.peak").Float()
 		track.completed = false
-		var queryUrl string = "/track/?id=" + strconv.Itoa(track.Id)
-		queryUrl += "&quality=" + QualityId
-
-		bodyBytes, err := request(queryUrl)
-		if err != nil {
-			fmt.Println(err)
-			return false
-		}
-		track.DownloadLink = gjson.Get(bodyBytes, "data.manifest").String()
-		manifest, _ := base64.StdEncoding.DecodeString(track.DownloadLink)
-		track.DownloadLink = gjson.Get(string(manifest), "urls.0").String()
 		download.Files = append(download.Files, track)
 		return true
 	})
-	Downloads[Id] = &download
+	assignTrackPaths(download)
+	return nil
+}
+
+// resolveTrack fetches the manifest for a track and extracts its download link
+func resolveTrack(track *File) error {
+	var queryUrl string = "/track/?id=" + strconv.Itoa(track.Id)
+	queryUrl += "&quality=" + QualityId
+
+	bodyBytes, err := request(queryUrl)
+	if err != nil {
+		return err
+	}
+	manifest, err := base64.StdEncoding.DecodeString(gjson.Get(bodyBytes, "data.manifest").String())
+	if err != nil {
+		return fmt.Errorf("couldn't decode manifest for track %d: %w", track.Id, err)
+	}
+	if gain := gjson.Get(bodyBytes, "data.trackReplayGain"); gain.Exists() {
+		track.replayGain = gain.Float()
+		track.peak = gjson.Get(bodyBytes, "data.trackPeakAmplitude").Float()
+	}
+	track.albumReplayGain = gjson.Get(bodyBytes, "data.albumReplayGain").Float()
+	track.albumPeak = gjson.Get(bodyBytes, "data.albumPeakAmplitude").Float()
+	track.DownloadLink = gjson.Get(string(manifest), "urls.0").String()
+	if track.DownloadLink == "" {
+		return fmt.Errorf("no download link in manifest for track %d", track.Id)
+	}
+	return nil
 }
 
 type QueueSlot struct {
@@ -274,8 +376,15 @@ type QueueSlot struct {
 }
 
 type Queue struct {
-	Paused bool        `json:"paused"`
-	Slots  []QueueSlot `json:"slots"`
+	Status          string      `json:"status"`
+	Paused          bool        `json:"paused"`
+	Diskspace1      string      `json:"diskspace1"`
+	Diskspace2      string      `json:"diskspace2"`
+	Diskspacetotal1 string      `json:"diskspacetotal1"`
+	Diskspacetotal2 string      `json:"diskspacetotal2"`
+	SpeedLimit      string      `json:"speedlimit"`
+	SpeedLimitAbs   string      `json:"speedlimit_abs"`
+	Slots           []QueueSlot `json:"slots"`
 }
 
 type QueueResponse struct {
@@ -283,15 +392,20 @@ type QueueResponse struct {
 }
 
 func queue(w http.ResponseWriter, r *http.Request) {
+	if err := json.NewEncoder(w).Encode(QueueResponse{Queue: queueState(queueSlots())}); err != nil {
+		slog.Error("Error encoding JSON", "error", err)
+	}
+}
+
+func queueSlots() []QueueSlot {
 	slots := []QueueSlot{}
 
 	//fill slots with current download queue
 	var index int = 0
-	for id := range Downloads {
-		var download Download = *Downloads[id]
-		if download.downloaded == download.numTracks {
+	for _, download := range listDownloads() {
+		if download.Status == StatusCompleted || download.Status == StatusFailed {
 			//shouldnt be in queue anymore, skipping
-			break
+			continue
 		}
 		//Don't know how long the download will take, so estimating 10 seconds per track remaining
 		timeleft := (download.numTracks - download.downloaded) * 10
@@ -299,7 +413,7 @@ func queue(w http.ResponseWriter, r *http.Request) {
 		progress := (int((float64(download.downloaded) / float64(download.numTracks)) * 100))
 
 		slots = append(slots, QueueSlot{
-			Status:       "Downloading",
+			Status:       download.Status,
 			Index:        index,
 			Password:     "",
 			AvgAge:       "2895d",
@@ -321,15 +435,27 @@ func queue(w http.ResponseWriter, r *http.Request) {
 		})
 		index++
 	}
+	return slots
+}
 
-	if err := json.NewEncoder(w).Encode(QueueResponse{
-		Queue: Queue{
-			Paused: false,
-			Slots:  slots,
-		},
-	}); err != nil {
-		fmt.Println("Error encoding JSON:", err)
+// queueState adds what SABnzbd reports about the whole queue: status, free space and speed limit
+func queueState(slots []QueueSlot) Queue {
+	//both folders live on DOWNLOAD_PATH, so they report the same space, in GB like SABnzbd
+	resp := Queue{Status: "Idle", Slots: slots}
+	resp.SpeedLimit, resp.SpeedLimitAbs = speedLimitFields()
+	if len(slots) > 0 {
+		resp.Status = StatusDownloading
 	}
+	if problem := diskSpaceProblem(0); problem != "" {
+		resp.Status = StatusPaused
+		resp.Paused = true
+	}
+	if free, total, err := availableSpace(); err == nil {
+		resp.Diskspace1 = strconv.FormatFloat(float64(free)/(1<<30), 'f', 2, 64)
+		resp.Diskspacetotal1 = strconv.FormatFloat(float64(total)/(1<<30), 'f', 2, 64)
+		resp.Diskspace2, resp.Diskspacetotal2 = resp.Diskspace1, resp.Diskspacetotal1
+	}
+	return resp
 }
 
 type HistorySlot struct {
@@ -341,6 +467,13 @@ type HistorySlot struct {
 	Status       string `json:"status"`
 	Storage      string `json:"storage"`
 	NzoId        string `json:"nzo_id"`
+	FailMessage  string `json:"fail_message"`
+	Script       string `json:"script"`
+	ScriptLog    string `json:"script_log"`
+	ScriptLine   string `json:"script_line"`
+	// not SABnzbd's, how the import triggered in Lidarr went
+	ImportStatus  string `json:"import_status,omitempty"`
+	ImportMessage string `json:"import_message,omitempty"`
 }
 
 type History struct {
@@ -356,51 +489,47 @@ func history(w http.ResponseWriter, r *http.Request) {
 	//api?mode=history&name=delete&del_files=1&value=SABnzbd_nzo_0825646642830&archive=1&apikey=(removed)&output=json
 	if r.URL.Query().Get("name") == "delete" {
 		var id, _ = strings.CutPrefix(r.URL.Query().Get("value"), "SABnzbd_nzo_")
-		if download, ok := Downloads[id]; ok {
+		if download, ok := getDownload(id); ok {
 			if r.URL.Query().Get("del_files") == "1" {
 				err := os.RemoveAll(filepath.Join(DownloadPath, "complete", Category, download.FileName))
 				if err != nil {
-					fmt.Println("Couldn't delete folder " + download.FileName)
-					fmt.Println(err)
+					slog.ErrorContext(r.Context(), "Couldn't delete folder", "nzo_id", "SABnzbd_nzo_"+id, "folder", download.FileName, "error", err)
 				}
+				forgetCompleteSize()
 			}
+			DownloadsMutex.Lock()
 			delete(Downloads, id)
+			DownloadsMutex.Unlock()
 		}
 	}
 
 	slots := []HistorySlot{}
 	//fill this with completed history
-	for id := range Downloads {
-		var download Download = *Downloads[id]
-		if download.downloaded < download.numTracks && download.downloaded != -1 {
+	for _, download := range listDownloads() {
+		if download.Status != StatusCompleted && download.Status != StatusFailed {
 			//not finished yet, skipping...
-			break
+			continue
 		}
-		// Get the fileinfo
-		fileInfo, err := os.Stat(filepath.Join(DownloadPath, "complete", Category, download.FileName))
-		var fileSize int64
-		if err != nil {
-			//cant get file stats on Docker for some reason? giving arbitrary size info
+		fileSize, err := folderSize(filepath.Join(DownloadPath, "complete", Category, download.FileName))
+		if err != nil || fileSize == 0 {
+			//nothing on disk (failed download?), giving arbitrary size info
 			fileSize = 10000
-		} else {
-			fileSize = fileInfo.Size()
-		}
-		var status string
-		if download.downloaded == -1 {
-			status = "Failed"
-		} else {
-			status = "Completed"
 		}
-
 		slots = append(slots, HistorySlot{
-			Name:         download.FileName,
-			NzbName:      download.FileName + ".nzb",
-			Category:     Category,
-			Bytes:        fileSize,
-			DownloadTime: download.numTracks * 30,
-			Status:       status,
-			Storage:      filepath.Join(DownloadPath, "complete", Category, download.FileName),
-			NzoId:        "SABnzbd_nzo_" + download.Id,
+			Name:          download.FileName,
+			NzbName:       download.FileName + ".nzb",
+			Category:      Category,
+			Bytes:         fileSize,
+			DownloadTime:  download.numTracks * 30,
+			Status:        download.Status,
+			Storage:       filepath.Join(DownloadPath, "complete", Category, download.FileName),
+			NzoId:         "SABnzbd_nzo_" + download.Id,
+			FailMessage:   download.FailMessage,
+			Script:        scriptName(),
+			ScriptLog:     download.scriptLog,
+			ScriptLine:    lastLine(download.scriptLog),
+			ImportStatus:  download.importStatus,
+			ImportMessage: download.importMessage,
 		})
 	}
 
@@ -409,7 +538,7 @@ func history(w http.ResponseWriter, r *http.Request) {
 			Slots: slots,
 		},
 	}); err != nil {
-		fmt.Println("Error encoding JSON:", err)
+		slog.Error("Error encoding JSON", "error", err)
 	}
 }
 
@@ -419,43 +548,109 @@ func sanitizeFilename(name string) string {
 	return re.ReplaceAllString(name, "_")
 }
 
-func startDownload(Id string) {
-	download, ok := Downloads[Id]
+func startDownload(Id string) error {
+	download, ok := getDownload(Id)
 	if !ok {
-		fmt.Println("Download ID not found: " + Id)
-		return
+		return errors.New("Download ID not found: " + Id)
 	}
-	//create folder
+	notify(EventStarted, download, 0)
+	//create folder, unless we're resuming into it
 	var Folder string = filepath.Join(DownloadPath, "incomplete", Category, download.FileName)
-	err := os.Mkdir(Folder, 0755)
+	err := os.MkdirAll(Folder, 0755)
 	if err != nil {
-		fmt.Println("Couldn't create folder in " + filepath.Join(DownloadPath, "incomplete", Category))
-		fmt.Println(err)
-		return
+		return fmt.Errorf("couldn't create folder in %s: %w", filepath.Join(DownloadPath, "incomplete", Category), err)
 	}
 	//Download cover art
-	_, err = grab.Get(filepath.Join(Folder, "cover.jpg"), download.CoverUrl)
+	cover, err := fetchFile(filepath.Join(Folder, "cover.jpg"), download.CoverUrl)
 	if err != nil {
-		fmt.Println("Failed to download cover")
-		fmt.Println(err)
-		return
+		return fmt.Errorf("failed to download cover: %w", err)
 	}
-	//Download each track
-	for _, track := range download.Files {
-		var Name string = sanitizeFilename(track.Index+" - "+download.Artist+" - "+track.Name) + FileExtension
-		_, err := grab.Get(filepath.Join(Folder, Name), track.DownloadLink)
-		if err != nil {
-			fmt.Println("Failed to download track " + track.Name)
-			fmt.Println(err)
-			return
+	recordTransfer(cover.BytesComplete())
+	//Download each track, resolving its manifest just before so the link doesn't expire
+	for i := range download.Files {
+		track := &download.Files[i]
+		if stopping.Load() {
+			return errInterrupted
+		}
+		var Name string = trackFileName(*download, *track) + FileExtension
+		if err := waitForDiskSpace(download, 0); err != nil {
+			return err
+		}
+		if download.resumeTracks[track.Id] && resumedTrackIntact(*track, filepath.Join(Folder, Name)) {
+			DownloadsMutex.Lock()
+			track.completed = true
+			download.downloaded += 1
+			DownloadsMutex.Unlock()
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(Folder, Name)), 0755); err != nil {
+			return fmt.Errorf("couldn't create disc folder: %w", err)
+		}
+		if err := downloadTrack(Id, track, filepath.Join(Folder, Name)); err != nil {
+			return err
 		}
 
+		writeMetaData(*download, *track, filepath.Join(Folder, Name))
+		if _, err := transcodeTrack(*download, *track, filepath.Join(Folder, Name)); err != nil {
+			return fmt.Errorf("failed to transcode track %s: %w", track.Name, err)
+		}
+		DownloadsMutex.Lock()
 		track.completed = true
 		download.downloaded += 1
-		writeMetaData(*download, track, filepath.Join(Folder, Name))
+		DownloadsMutex.Unlock()
+	}
+	if err := writeReplayGain(*download, Folder); err != nil {
+		slog.Warn("Couldn't write ReplayGain tags", "nzo_id", "SABnzbd_nzo_"+Id, "error", err)
+		addWarning("SABnzbd_nzo_"+Id, "Couldn't write ReplayGain tags for "+download.FileName+": "+err.Error())
+	}
+	if err := writeManifest(*download, Folder); err != nil {
+		slog.Warn("Couldn't write album manifest", "nzo_id", "SABnzbd_nzo_"+Id, "error", err)
+	}
+	//Download complete, move to complete folder
+	if err := moveFolder(Folder, filepath.Join(DownloadPath, "complete", Category, download.FileName)); err != nil {
+		return fmt.Errorf("couldn't move album to the complete folder: %w", err)
+	}
+	return nil
+}
+
+// downloadTrack downloads a track and verifies it, downloading it again while it comes out damaged
+func downloadTrack(Id string, track *File, path string) error {
+	var verifyErr error
+	for attempt := 0; attempt <= VerifyRetries; attempt++ {
+		if attempt > 0 {
+			slog.Warn("Track failed verification, downloading it again", "nzo_id", "SABnzbd_nzo_"+Id, "track_id", track.Id, "attempt", attempt, "error", verifyErr)
+			addWarning("SABnzbd_nzo_"+Id, fmt.Sprintf("Track %s failed verification, downloading it again: %v", track.Name, verifyErr))
+		}
+		//a damaged file left behind would make grab resume it instead of starting over
+		os.Remove(path)
+		if err := resolveTrack(track); err != nil {
+			return fmt.Errorf("failed to resolve track %s: %w", track.Name, err)
+		}
+		start := time.Now()
+		resp, err := fetchFile(path, track.DownloadLink)
+		if err != nil {
+			return fmt.Errorf("failed to download track %s: %w", track.Name, err)
+		}
+		recordTransfer(resp.BytesComplete())
+		slog.Debug("Downloaded track", "nzo_id", "SABnzbd_nzo_"+Id, "track_id", track.Id, "bytes", resp.BytesComplete(), "duration", time.Since(start))
+		if verifyErr = verifyTrack(path, track.duration); verifyErr == nil {
+			tracksDownloadedTotal.inc()
+			return nil
+		}
+		tracksFailedVerificationTotal.inc()
+	}
+	os.Remove(path)
+	return fmt.Errorf("track %s failed verification %d times: %w", track.Name, VerifyRetries+1, verifyErr)
+}
+
+// resumedTrackIntact reports whether a track downloaded before a restart can be kept. Only the untouched source is
+// verified, a transcoded track is trusted.
+func resumedTrackIntact(track File, path string) bool {
+	if _, err := os.Stat(path); err == nil {
+		return verifyTrack(path, track.duration) == nil
 	}
-	//Download (should be) complete, move to complete folder
-	os.Rename(Folder, filepath.Join(DownloadPath, "complete", Category, download.FileName))
+	_, err := os.Stat(strings.TrimSuffix(path, FileExtension) + outputExtension())
+	return err == nil
 }
 
 func writeMetaData(album Download, track File, fileName string) {
@@ -470,9 +665,9 @@ func writeMetaData(album Download, track File, fileName string) {
 		taglib.Label:       {album.label},
 		taglib.ISRC:        {track.isrc},
 		taglib.Lyrics:      {track.Lyrics},
+		tidalAlbumIdTag:    {album.Id},
 	}, 0)
 	if err != nil {
-		fmt.Println("Couldn't write Metadata to file " + fileName)
-		fmt.Println(err)
+		slog.Warn("Couldn't write metadata", "nzo_id", "SABnzbd_nzo_"+album.Id, "track_id", track.Id, "file", fileName, "error", err)
 	}
 }
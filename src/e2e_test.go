@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testApiKey = "secret"
+
+var testAlbums = []fakeAlbum{
+	{
+		Id:          "1001",
+		Artist:      "The Testers",
+		Title:       "Green Bar",
+		ReleaseDate: "2021-03-05",
+		Copyright:   "Fixture Records",
+		Cover:       "aaaa-bbbb-cccc",
+		Tracks: []fakeTrack{
+			{Id: 11, Title: "Setup", TrackNumber: 1, VolumeNumber: 1, Isrc: "XX0000000011", Duration: 1},
+			{Id: 12, Title: "Teardown", TrackNumber: 2, VolumeNumber: 1, Isrc: "XX0000000012", Duration: 1},
+		},
+	},
+	{
+		Id:          "1002",
+		Artist:      "The Testers",
+		Title:       "Red Bar",
+		ReleaseDate: "2019-11-01",
+		Copyright:   "Fixture Records",
+		Cover:       "dddd-eeee-ffff",
+		Tracks: []fakeTrack{
+			{Id: 21, Title: "Flaky", TrackNumber: 1, VolumeNumber: 1, Isrc: "XX0000000021", Duration: 1},
+		},
+	},
+}
+
+// testProxy is a running tidlarr-proxy pointed at a fake upstream, with its own download folder
+type testProxy struct {
+	*httptest.Server
+	Upstream *fakeUpstream
+}
+
+func newTestProxy(t *testing.T, quality string, albums ...fakeAlbum) *testProxy {
+	t.Helper()
+	if len(albums) == 0 {
+		albums = testAlbums
+	}
+	upstream := newFakeUpstream(t, albums...)
+
+	oldApiLink, oldImageHost := ApiLink, ImageHost
+	oldDownloadPath, oldCategory, oldApiKey := DownloadPath, Category, ApiKey
+	oldQualityId, oldFileExtension := QualityId, FileExtension
+	t.Cleanup(func() {
+		ApiLink, ImageHost = oldApiLink, oldImageHost
+		DownloadPath, Category, ApiKey = oldDownloadPath, oldCategory, oldApiKey
+		QualityId, FileExtension = oldQualityId, oldFileExtension
+		DownloadsMutex.Lock()
+		Downloads = make(map[string]*Download)
+		DownloadsMutex.Unlock()
+	})
+
+	ApiLink = []string{upstream.URL}
+	ImageHost = upstream.URL
+	DownloadPath = t.TempDir()
+	Category = "music"
+	ApiKey = testApiKey
+	setQuality(quality)
+	DownloadsMutex.Lock()
+	Downloads = make(map[string]*Download)
+	DownloadsMutex.Unlock()
+	if err := createFolders(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := httptest.NewServer(routes())
+	t.Cleanup(proxy.Close)
+	return &testProxy{Server: proxy, Upstream: upstream}
+}
+
+func (p *testProxy) get(t *testing.T, path string, params url.Values) string {
+	t.Helper()
+	_, body := p.getStatus(t, path, params)
+	return body
+}
+
+func (p *testProxy) getStatus(t *testing.T, path string, params url.Values) (int, string) {
+	t.Helper()
+	if params.Get("apikey") == "" {
+		params.Set("apikey", testApiKey)
+	}
+	resp, err := http.Get(p.URL + path + "?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func (p *testProxy) search(t *testing.T, params url.Values) Rss {
+	t.Helper()
+	var rss Rss
+	body := p.get(t, "/indexer", params)
+	if err := xml.Unmarshal([]byte(body), &rss); err != nil {
+		t.Fatalf("couldn't parse search response %q: %v", body, err)
+	}
+	// the encoder writes newznab:attr literally, but the decoder matches it by local name
+	var attrs struct {
+		Items []struct {
+			Attrs []NewznabAttr `xml:"attr"`
+		} `xml:"channel>item"`
+	}
+	xml.Unmarshal([]byte(body), &attrs)
+	for i := range attrs.Items {
+		rss.Channel.Items[i].Attrs = attrs.Items[i].Attrs
+	}
+	return rss
+}
+
+func (p *testProxy) queue(t *testing.T) QueueResponse {
+	t.Helper()
+	var queue QueueResponse
+	body := p.get(t, "/downloader/api", url.Values{"mode": {"queue"}, "output": {"json"}})
+	if err := json.Unmarshal([]byte(body), &queue); err != nil {
+		t.Fatalf("couldn't parse queue response %q: %v", body, err)
+	}
+	return queue
+}
+
+func (p *testProxy) history(t *testing.T, params url.Values) HistoryResponse {
+	t.Helper()
+	var history HistoryResponse
+	params.Set("mode", "history")
+	params.Set("output", "json")
+	body := p.get(t, "/downloader/api", params)
+	if err := json.Unmarshal([]byte(body), &history); err != nil {
+		t.Fatalf("couldn't parse history response %q: %v", body, err)
+	}
+	return history
+}
+
+// addfile uploads an nzb the same way Lidarr's SABnzbd client does
+func (p *testProxy) addfile(t *testing.T, name string, nzb []byte) map[string]any {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("name", name+".nzb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(nzb)
+	form.Close()
+
+	params := url.Values{"mode": {"addfile"}, "cat": {"music"}, "priority": {"-100"}, "output": {"json"}, "apikey": {testApiKey}}
+	resp, err := http.Post(p.URL+"/downloader/api?"+params.Encode(), form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	result := map[string]any{"http_status": float64(resp.StatusCode)}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// grab fetches the nzb behind a search result and hands it to the downloader
+func (p *testProxy) grab(t *testing.T, item Item) string {
+	t.Helper()
+	link, err := url.Parse(item.Enclosure.Url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nzb := p.get(t, link.Path, link.Query())
+	result := p.addfile(t, item.Title, []byte(nzb))
+	if result["status"] != true {
+		t.Fatalf("addfile failed: %v", result)
+	}
+	ids, _ := result["nzo_ids"].([]any)
+	if len(ids) != 1 {
+		t.Fatalf("expected one nzo_id, got %v", result)
+	}
+	return ids[0].(string)
+}
+
+// waitForHistory polls like Lidarr does until the job shows up in history with a final status
+func (p *testProxy) waitForHistory(t *testing.T, nzoId string) HistorySlot {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, slot := range p.history(t, url.Values{}).History.Slots {
+			if slot.NzoId != nzoId {
+				continue
+			}
+			if slot.Status == "Failed" {
+				return slot
+			}
+			if _, err := os.Stat(slot.Storage); slot.Status == "Completed" && err == nil {
+				return slot
+			}
+		}
+		p.queue(t)
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("%s never finished", nzoId)
+	return HistorySlot{}
+}
+
+func findItem(t *testing.T, rss Rss, substring string) Item {
+	t.Helper()
+	for _, item := range rss.Channel.Items {
+		if strings.Contains(item.Title, substring) {
+			return item
+		}
+	}
+	t.Fatalf("no result containing %q in %v", substring, rss.Channel.Items)
+	return Item{}
+}
+
+func attr(item Item, name string) string {
+	for _, a := range item.Attrs {
+		if a.Name == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func TestIndexerRejectsWrongApiKey(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	body := proxy.get(t, "/indexer", url.Values{"t": {"caps"}, "apikey": {"wrong"}})
+	if !strings.Contains(body, `code="100"`) {
+		t.Errorf("expected credentials error, got %q", body)
+	}
+}
+
+func TestIndexerCaps(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	body := proxy.get(t, "/indexer", url.Values{"t": {"caps"}})
+	if !strings.Contains(body, "<caps>") || !strings.Contains(body, `id="3040"`) {
+		t.Errorf("unexpected caps %q", body)
+	}
+}
+
+func TestIndexerTestRequestReturnsItem(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	rss := proxy.search(t, url.Values{"t": {"search"}})
+	if len(rss.Channel.Items) == 0 {
+		t.Error("Lidarr's indexer test needs at least one item for an empty query")
+	}
+}
+
+func TestIndexerSearch(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	rss := proxy.search(t, url.Values{"t": {"search"}, "q": {"Testers Green"}})
+	if len(rss.Channel.Items) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(rss.Channel.Items))
+	}
+	item := rss.Channel.Items[0]
+	if item.Title != "The Testers-Green Bar-16BIT-44-KHZ-WEB-FLAC-2021-TIDLARR" {
+		t.Errorf("unexpected release name %q", item.Title)
+	}
+	if attr(item, "size") == "" || item.Category != "Audio > Lossless" {
+		t.Errorf("missing lossless category or size: %+v", item)
+	}
+	if !strings.Contains(item.Enclosure.Url, "tidalid=1001") || !strings.Contains(item.Enclosure.Url, "numtracks=2") {
+		t.Errorf("enclosure doesn't carry the album: %q", item.Enclosure.Url)
+	}
+}
+
+func TestIndexerMusicSearch(t *testing.T) {
+	proxy := newTestProxy(t, "aac-320")
+	rss := proxy.search(t, url.Values{"t": {"music"}, "artist": {"The Testers"}, "album": {"Red Bar"}})
+	item := findItem(t, rss, "Red Bar")
+	if item.Title != "The Testers-Red Bar-WEB-320-AAC-2019-TIDLARR" {
+		t.Errorf("unexpected release name %q", item.Title)
+	}
+	if item.Category != "Audio > MP3" {
+		t.Errorf("unexpected category %q", item.Category)
+	}
+}
+
+func TestDownloaderVersionAndConfig(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	if body := proxy.get(t, "/downloader/api", url.Values{"mode": {"version"}}); !strings.Contains(body, "4.5.1") {
+		t.Errorf("unexpected version %q", body)
+	}
+	var config ConfigResponse
+	body := proxy.get(t, "/downloader/api", url.Values{"mode": {"get_config"}})
+	if err := json.Unmarshal([]byte(body), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Config.Misc.CompleteDir != filepath.Join(DownloadPath, "complete") {
+		t.Errorf("unexpected complete dir %q", config.Config.Misc.CompleteDir)
+	}
+}
+
+func TestGrabLifecycle(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	rss := proxy.search(t, url.Values{"t": {"music"}, "artist": {"The Testers"}, "album": {"Green Bar"}})
+	item := findItem(t, rss, "Green Bar")
+
+	nzoId := proxy.grab(t, item)
+	if nzoId != "SABnzbd_nzo_1001" {
+		t.Errorf("unexpected nzo_id %q", nzoId)
+	}
+
+	slot := proxy.waitForHistory(t, nzoId)
+	if slot.Status != "Completed" {
+		t.Fatalf("download failed: %+v", slot)
+	}
+	if slot.Name != item.Title {
+		t.Errorf("history name %q doesn't match release %q", slot.Name, item.Title)
+	}
+	files, err := os.ReadDir(slot.Storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	expected := []string{".tidlarr.json", "01 - The Testers - Setup.flac", "02 - The Testers - Teardown.flac", "cover.jpg"}
+	if strings.Join(names, "|") != strings.Join(expected, "|") {
+		t.Errorf("unexpected files %v", names)
+	}
+	if len(proxy.queue(t).Queue.Slots) != 0 {
+		t.Error("finished download still in queue")
+	}
+
+	proxy.history(t, url.Values{"name": {"delete"}, "del_files": {"1"}, "value": {nzoId}, "archive": {"1"}})
+	if _, err := os.Stat(slot.Storage); !os.IsNotExist(err) {
+		t.Errorf("files weren't deleted: %v", err)
+	}
+	if len(proxy.history(t, url.Values{}).History.Slots) != 0 {
+		t.Error("deleted download still in history")
+	}
+}
+
+func TestGrabViaAddurl(t *testing.T) {
+	proxy := newTestProxy(t, "aac-320")
+	item := findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Red Bar"}}), "Red Bar")
+
+	nzbUrl := proxy.URL + item.Enclosure.Url
+	body := proxy.get(t, "/downloader/api", url.Values{"mode": {"addurl"}, "name": {nzbUrl}, "nzbname": {item.Title}, "cat": {"music"}})
+	if !strings.Contains(body, "SABnzbd_nzo_1002") {
+		t.Fatalf("unexpected addurl response %q", body)
+	}
+
+	slot := proxy.waitForHistory(t, "SABnzbd_nzo_1002")
+	if slot.Status != "Completed" {
+		t.Fatalf("download failed: %+v", slot)
+	}
+	if _, err := os.Stat(filepath.Join(slot.Storage, "01 - The Testers - Flaky.m4a")); err != nil {
+		t.Error(err)
+	}
+	if proxy.Upstream.Hits("/track/") != 1 {
+		t.Errorf("expected one track request, got %d", proxy.Upstream.Hits("/track/"))
+	}
+}
+
+func TestGrabReturnsBeforeAlbumIsFetched(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	item := findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Green Bar"}}), "Green Bar")
+	release := proxy.Upstream.Stall("/album")
+
+	nzoId := proxy.grab(t, item)
+	queue := proxy.queue(t).Queue
+	if len(queue.Slots) != 1 || queue.Slots[0].NzoId != nzoId {
+		t.Fatalf("grab should be in the queue right away: %+v", queue)
+	}
+	if status := queue.Slots[0].Status; status != StatusQueued && status != StatusFetching {
+		t.Errorf("unexpected status %q while the album is being fetched", status)
+	}
+	if proxy.Upstream.Hits("/track/") != 0 {
+		t.Error("track manifests shouldn't be fetched at grab time")
+	}
+
+	release()
+	if slot := proxy.waitForHistory(t, nzoId); slot.Status != StatusCompleted {
+		t.Fatalf("download failed: %+v", slot)
+	}
+	if proxy.Upstream.Hits("/track/") != 2 {
+		t.Errorf("expected one manifest request per track, got %d", proxy.Upstream.Hits("/track/"))
+	}
+}
+
+func TestGrabOfMissingAlbumFails(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	nzb := proxy.get(t, "/indexer", url.Values{"t": {"fakenzb"}, "name": {"Nobody-Nothing-TIDLARR"}, "tidalid": {"9999"}, "numtracks": {"3"}})
+	result := proxy.addfile(t, "Nobody-Nothing-TIDLARR", []byte(nzb))
+	nzoId := result["nzo_ids"].([]any)[0].(string)
+	slot := proxy.waitForHistory(t, nzoId)
+	if slot.Status != StatusFailed || !strings.Contains(slot.FailMessage, "9999") {
+		t.Errorf("expected failure with a reason, got %+v", slot)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Tidal lists explicit and clean versions, and deluxe or remastered editions, as separate albums. Release names
+// carry the edition, and EXPLICIT for explicit albums whatever else a search finds, so Lidarr always sees the same
+// name for an album. EXPLICIT_PREFERENCE=explicit drops the clean version of albums that also come explicit, clean does
+// the opposite, and both (the default) lists both.
+
+var ExplicitPreference string = "both"
+
+func setupEditions() {
+	ExplicitPreference = strings.ToLower(getEnv("EXPLICIT_PREFERENCE", "both"))
+	if ExplicitPreference != "explicit" && ExplicitPreference != "clean" && ExplicitPreference != "both" {
+		exitWithError("Invalid EXPLICIT_PREFERENCE", fmt.Errorf("%q isn't explicit, clean or both", ExplicitPreference))
+	}
+}
+
+// versionKey is the same for the explicit and clean version of an album
+func versionKey(album Album) string {
+	return normalizeName(baseName(album.Artist)) + "|" + normalizeName(album.Title+" "+album.Edition) + "|" + album.ReleaseDate[:min(4, len(album.ReleaseDate))]
+}
+
+// preferVersions drops the version EXPLICIT_PREFERENCE doesn't want
+func preferVersions(albums []Album) []Album {
+	explicit := map[string]bool{}
+	clean := map[string]bool{}
+	for _, album := range albums {
+		if album.Explicit {
+			explicit[versionKey(album)] = true
+		} else {
+			clean[versionKey(album)] = true
+		}
+	}
+	var preferred []Album
+	for _, album := range albums {
+		key := versionKey(album)
+		both := explicit[key] && clean[key]
+		if both && (ExplicitPreference == "explicit" && !album.Explicit || ExplicitPreference == "clean" && album.Explicit) {
+			continue
+		}
+		preferred = append(preferred, album)
+	}
+	return preferred
+}
+
+// releaseTitle is the album's title with its edition, and whether it's explicit
+func releaseTitle(album Album) string {
+	title := album.Title
+	if album.Edition != "" && !strings.Contains(strings.ToLower(title), strings.ToLower(album.Edition)) {
+		title += " (" + album.Edition + ")"
+	}
+	if album.Explicit {
+		title += "-EXPLICIT"
+	}
+	return title
+}
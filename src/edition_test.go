@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func versionAlbums() []fakeAlbum {
+	track := []fakeTrack{{Id: 91, Title: "One", TrackNumber: 1, VolumeNumber: 1, Duration: 1}}
+	return []fakeAlbum{
+		{Id: "5001", Artist: "The Testers", Title: "Loud Bar", ReleaseDate: "2022-02-02", Explicit: true, Tracks: track},
+		{Id: "5002", Artist: "The Testers", Title: "Loud Bar", ReleaseDate: "2022-02-02", Tracks: track},
+		{Id: "5003", Artist: "The Testers", Title: "Loud Bar", Version: "Deluxe Edition", ReleaseDate: "2023-02-02", Tracks: track},
+	}
+}
+
+func usePreference(t *testing.T, preference string) {
+	t.Helper()
+	old := ExplicitPreference
+	t.Cleanup(func() { ExplicitPreference = old })
+	ExplicitPreference = preference
+}
+
+func TestReleaseNamesCarryEditionAndVersion(t *testing.T) {
+	proxy := newTestProxy(t, "flac", versionAlbums()...)
+	usePreference(t, "both")
+
+	rss := proxy.search(t, url.Values{"t": {"music"}, "artist": {"The Testers"}, "album": {"Loud Bar"}})
+	names := map[string]Item{}
+	for _, item := range rss.Channel.Items {
+		names[item.Title] = item
+	}
+	for _, name := range []string{
+		"The Testers-Loud Bar-EXPLICIT-16BIT-44-KHZ-WEB-FLAC-2022-TIDLARR",
+		"The Testers-Loud Bar-16BIT-44-KHZ-WEB-FLAC-2022-TIDLARR",
+		"The Testers-Loud Bar (Deluxe Edition)-16BIT-44-KHZ-WEB-FLAC-2023-TIDLARR",
+	} {
+		if _, ok := names[name]; !ok {
+			t.Errorf("missing %q in %v", name, names)
+		}
+	}
+	deluxe := names["The Testers-Loud Bar (Deluxe Edition)-16BIT-44-KHZ-WEB-FLAC-2023-TIDLARR"]
+	if attr(deluxe, "edition") != "Deluxe Edition" || attr(deluxe, "explicit") != "false" {
+		t.Errorf("unexpected attrs %+v", deluxe.Attrs)
+	}
+}
+
+func TestExplicitPreference(t *testing.T) {
+	proxy := newTestProxy(t, "flac", versionAlbums()...)
+	for preference, want := range map[string]string{
+		"explicit": "5001,5003",
+		"clean":    "5002,5003",
+	} {
+		usePreference(t, preference)
+		rss := proxy.search(t, url.Values{"t": {"music"}, "artist": {"The Testers"}, "album": {"Loud Bar"}})
+		got := ""
+		for _, item := range rss.Channel.Items {
+			if got != "" {
+				got += ","
+			}
+			got += item.Guid.Value[len("http://www.tidal.com/album?id="):]
+		}
+		if got != want {
+			t.Errorf("with %s preferred expected %s, got %s", preference, want, got)
+		}
+	}
+
+	// an album only released clean is kept either way
+	usePreference(t, "explicit")
+	if albums := preferVersions([]Album{{Id: "1", Artist: "A", Title: "B", ReleaseDate: "2020-01-01"}}); len(albums) != 1 {
+		t.Errorf("unexpected %+v", albums)
+	}
+}
+
+func TestExplicitMarkerDoesntDependOnQuery(t *testing.T) {
+	track := []fakeTrack{{Id: 91, Title: "One", TrackNumber: 1, VolumeNumber: 1, Duration: 1}}
+	proxy := newTestProxy(t, "flac", append(versionAlbums(), fakeAlbum{Id: "5004", Artist: "The Testers", Title: "Rude Bar", ReleaseDate: "2022-02-02", Explicit: true, Tracks: track})...)
+	for _, preference := range []string{"both", "explicit"} {
+		usePreference(t, preference)
+		for query, name := range map[string]string{
+			"Rude Bar": "The Testers-Rude Bar-EXPLICIT-16BIT-44-KHZ-WEB-FLAC-2022-TIDLARR",
+			"Loud Bar": "The Testers-Loud Bar-EXPLICIT-16BIT-44-KHZ-WEB-FLAC-2022-TIDLARR",
+		} {
+			for _, params := range []url.Values{
+				{"t": {"music"}, "artist": {"The Testers"}, "album": {query}},
+				{"t": {"search"}, "q": {"The Testers " + query}},
+			} {
+				if item := findItem(t, proxy.search(t, params), name); attr(item, "explicit") != "true" {
+					t.Errorf("unexpected attrs %+v", item.Attrs)
+				}
+			}
+		}
+	}
+}
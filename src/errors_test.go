@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func newznabCode(t *testing.T, body string) int {
+	t.Helper()
+	var e NewznabError
+	if err := xml.Unmarshal([]byte(body), &e); err != nil {
+		t.Fatalf("not a newznab error %q: %v", body, err)
+	}
+	return e.Code
+}
+
+func sabStatus(t *testing.T, body string) (bool, string) {
+	t.Helper()
+	var result struct {
+		Status bool   `json:"status"`
+		Error  string `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(body), &result); err != nil {
+		t.Fatalf("not a SABnzbd response %q: %v", body, err)
+	}
+	return result.Status, result.Error
+}
+
+func TestSearchReportsUpstreamFailure(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	ApiLink = []string{"http://127.0.0.1:1"}
+	status, body := proxy.getStatus(t, "/indexer", url.Values{"t": {"search"}, "q": {"Green Bar"}})
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", status)
+	}
+	if code := newznabCode(t, body); code != 900 {
+		t.Errorf("expected code 900, got %d", code)
+	}
+}
+
+func TestIndexerErrors(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	status, body := proxy.getStatus(t, "/indexer", url.Values{"t": {"caps"}, "apikey": {"wrong"}})
+	if status != http.StatusUnauthorized || newznabCode(t, body) != 100 {
+		t.Errorf("unexpected credentials error %d %q", status, body)
+	}
+	status, body = proxy.getStatus(t, "/indexer", url.Values{"t": {"tvsearch"}})
+	if status != http.StatusBadRequest || newznabCode(t, body) != 202 {
+		t.Errorf("unexpected unknown function error %d %q", status, body)
+	}
+	status, body = proxy.getStatus(t, "/indexer", url.Values{"t": {"fakenzb"}})
+	if status != http.StatusBadRequest || newznabCode(t, body) != 200 {
+		t.Errorf("unexpected missing parameter error %d %q", status, body)
+	}
+}
+
+func TestDownloaderErrors(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	status, body := proxy.getStatus(t, "/downloader/api", url.Values{"mode": {"queue"}, "apikey": {"wrong"}})
+	if ok, message := sabStatus(t, body); status != http.StatusForbidden || ok || message != "API Key Incorrect" {
+		t.Errorf("unexpected credentials error %d %q", status, body)
+	}
+	status, body = proxy.getStatus(t, "/downloader/api", url.Values{"mode": {"addurl"}, "name": {"http://example.com/some.nzb"}})
+	if ok, _ := sabStatus(t, body); status != http.StatusBadRequest || ok {
+		t.Errorf("addurl accepted a foreign nzb: %d %q", status, body)
+	}
+	result := proxy.addfile(t, "garbage", []byte("<nzb></nzb>"))
+	if result["status"] != false || result["http_status"] != float64(http.StatusBadRequest) {
+		t.Errorf("addfile accepted a foreign nzb: %v", result)
+	}
+	if len(proxy.queue(t).Queue.Slots) != 0 {
+		t.Error("rejected grabs shouldn't be queued")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"math"
+)
+
+// bitWriter packs big-endian bit fields the way FLAC frames expect them
+type bitWriter struct {
+	buf   bytes.Buffer
+	acc   uint64
+	nbits uint
+}
+
+func (b *bitWriter) write(value uint64, bits uint) {
+	for i := int(bits) - 1; i >= 0; i-- {
+		b.acc = b.acc<<1 | (value>>uint(i))&1
+		b.nbits++
+		if b.nbits == 8 {
+			b.buf.WriteByte(byte(b.acc))
+			b.acc = 0
+			b.nbits = 0
+		}
+	}
+}
+
+func (b *bitWriter) align() {
+	for b.nbits != 0 {
+		b.write(0, 1)
+	}
+}
+
+func crc8(data []byte) byte {
+	var crc byte
+	for _, d := range data {
+		crc ^= d
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, d := range data {
+		crc ^= uint16(d) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// makeFlac encodes a stereo 16 bit 44.1kHz sine tone as a valid FLAC stream using verbatim subframes.
+// It's not small, but it decodes everywhere and carries a correct STREAMINFO MD5.
+func makeFlac(seconds float64, frequency float64) []byte {
+	return encodeFlac(seconds, frequency, false)
+}
+
+// makeCompressedFlac encodes the same tone with predicted subframes and Rice coded residuals, alternating between
+// mid/side frames with a fixed predictor and left/side frames with an LPC one
+func makeCompressedFlac(seconds float64, frequency float64) []byte {
+	return encodeFlac(seconds, frequency, true)
+}
+
+// writeResidual Rice codes the residual of a predicted subframe in a single partition
+func writeResidual(w *bitWriter, residual []int32) {
+	var total uint64
+	for _, e := range residual {
+		total += uint64(uint32(e<<1 ^ e>>31))
+	}
+	parameter := uint(0)
+	for len(residual) > 0 && total/uint64(len(residual)) > 1<<parameter && parameter < 14 {
+		parameter++
+	}
+	w.write(0, 2) // 4 bit Rice parameters
+	w.write(0, 4) // one partition
+	w.write(uint64(parameter), 4)
+	for _, e := range residual {
+		u := uint64(uint32(e<<1 ^ e>>31))
+		for q := u >> parameter; q > 0; q-- {
+			w.write(0, 1)
+		}
+		w.write(1, 1)
+		w.write(u&(1<<parameter-1), parameter)
+	}
+}
+
+func encodeFlac(seconds float64, frequency float64, compressed bool) []byte {
+	const sampleRate = 44100
+	const blockSize = 4096
+	total := int(seconds * sampleRate)
+	samples := make([]int16, total)
+	for i := range samples {
+		samples[i] = int16(8000 * math.Sin(2*math.Pi*frequency*float64(i)/sampleRate))
+	}
+
+	sum := md5.New()
+	for _, sample := range samples {
+		// both channels carry the same signal
+		binary.Write(sum, binary.LittleEndian, sample)
+		binary.Write(sum, binary.LittleEndian, sample)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("fLaC")
+	var info bitWriter
+	info.write(1, 1) // last metadata block
+	info.write(0, 7) // STREAMINFO
+	info.write(34, 24)
+	info.write(blockSize, 16)
+	info.write(blockSize, 16)
+	info.write(0, 24)
+	info.write(0, 24)
+	info.write(sampleRate, 20)
+	info.write(2-1, 3)
+	info.write(16-1, 5)
+	info.write(uint64(total), 36)
+	out.Write(info.buf.Bytes())
+	out.Write(sum.Sum(nil))
+
+	for frame := 0; frame*blockSize < total; frame++ {
+		block := samples[frame*blockSize : min((frame+1)*blockSize, total)]
+		var w bitWriter
+		w.write(0xFFF8, 16) // sync code, fixed blocksize
+		w.write(0x7, 4)     // 16 bit blocksize-1 at the end of the header
+		w.write(0x9, 4)     // 44.1kHz
+		switch {
+		case !compressed:
+			w.write(0x1, 4) // left/right
+		case frame%2 == 0:
+			w.write(0xA, 4) // mid/side
+		default:
+			w.write(0x8, 4) // left/side
+		}
+		w.write(0x4, 3) // 16 bits per sample
+		w.write(0, 1)
+		if frame < 0x80 {
+			w.write(uint64(frame), 8)
+		} else {
+			w.write(0xC0|uint64(frame>>6), 8)
+			w.write(0x80|uint64(frame&0x3F), 8)
+		}
+		w.write(uint64(len(block)-1), 16)
+		w.write(uint64(crc8(w.buf.Bytes())), 8)
+		if compressed {
+			// both channels are equal, so the first carries the signal and the side channel is silent
+			if frame%2 == 0 {
+				w.write(0x14, 8) // fixed predictor, order 2
+				w.write(uint64(uint16(block[0])), 16)
+				w.write(uint64(uint16(block[1])), 16)
+			} else {
+				w.write(0x42, 8) // LPC, order 2
+				w.write(uint64(uint16(block[0])), 16)
+				w.write(uint64(uint16(block[1])), 16)
+				w.write(3, 4)   // 4 bit coefficients
+				w.write(0, 5)   // no shift
+				w.write(2, 4)   // 2 * s[i-1]
+				w.write(0xF, 4) // -1 * s[i-2]
+			}
+			residual := make([]int32, 0, len(block))
+			for i := 2; i < len(block); i++ {
+				residual = append(residual, int32(block[i])-2*int32(block[i-1])+int32(block[i-2]))
+			}
+			writeResidual(&w, residual)
+			w.write(0x00, 8) // constant side channel
+			w.write(0, 17)
+		} else {
+			for channel := 0; channel < 2; channel++ {
+				w.write(0x02, 8) // verbatim subframe, no wasted bits
+				for _, sample := range block {
+					w.write(uint64(uint16(sample)), 16)
+				}
+			}
+		}
+		w.align()
+		w.write(uint64(crc16(w.buf.Bytes())), 16)
+		out.Write(w.buf.Bytes())
+	}
+	return out.Bytes()
+}
+
+func mp4Box(kind string, payload ...[]byte) []byte {
+	var body bytes.Buffer
+	for _, p := range payload {
+		body.Write(p)
+	}
+	box := make([]byte, 8, 8+body.Len())
+	binary.BigEndian.PutUint32(box, uint32(8+body.Len()))
+	copy(box[4:], kind)
+	return append(box, body.Bytes()...)
+}
+
+// makeM4a builds a bare MP4 container with a movie header and a media box. No actual AAC frames,
+// but enough structure for anything that only walks the top level boxes.
+func makeM4a(seconds float64) []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000) // timescale
+	binary.BigEndian.PutUint32(mvhd[16:], uint32(seconds*1000))
+	binary.BigEndian.PutUint32(mvhd[20:], 0x00010000) // rate 1.0
+	binary.BigEndian.PutUint16(mvhd[24:], 0x0100)     // volume 1.0
+	binary.BigEndian.PutUint32(mvhd[96:], 2)          // next track id
+	return bytes.Join([][]byte{
+		mp4Box("ftyp", []byte("M4A "), []byte{0, 0, 0, 0}, []byte("M4A mp42isom")),
+		mp4Box("moov", mp4Box("mvhd", mvhd)),
+		mp4Box("mdat", bytes.Repeat([]byte{0}, 1024)),
+	}, nil)
+}
+
+// oggPage wraps one packet of under 255 bytes in an Ogg page
+func oggPage(kind byte, granule uint64, sequence uint32, packet []byte) []byte {
+	page := []byte("OggS")
+	page = append(page, 0, kind)
+	page = binary.LittleEndian.AppendUint64(page, granule)
+	page = binary.LittleEndian.AppendUint32(page, 1)
+	page = binary.LittleEndian.AppendUint32(page, sequence)
+	page = append(page, 0, 0, 0, 0, 1, byte(len(packet)))
+	page = append(page, packet...)
+	var crc uint32
+	for _, c := range page {
+		crc ^= uint32(c) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	binary.LittleEndian.PutUint32(page[22:], crc)
+	return page
+}
+
+// makeOpus builds an Ogg Opus stream of a single silent frame, enough for taglib to tag it
+func makeOpus() []byte {
+	head := append([]byte("OpusHead"), 1, 2, 0x38, 0x01, 0x80, 0xBB, 0, 0, 0, 0, 0)
+	tags := append([]byte("OpusTags"), 4, 0, 0, 0, 't', 'e', 's', 't', 0, 0, 0, 0)
+	out := oggPage(0x02, 0, 0, head)
+	out = append(out, oggPage(0, 0, 1, tags)...)
+	return append(out, oggPage(0x04, 312+960, 2, []byte{0xF8, 0xFF, 0xFE})...)
+}
@@ -6,6 +6,7 @@ require (
 	github.com/cavaliergopher/grab/v3 v3.0.1
 	github.com/tidwall/gjson v1.18.0
 	go.senan.xyz/taglib v0.7.0
+	golang.org/x/text v0.34.0
 )
 
 require (
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MinFreeSpace is the free space DOWNLOAD_PATH needs before we report ready
+var MinFreeSpace int64
+var UpstreamWindow time.Duration
+
+var mirrorLastSeen = map[string]time.Time{}
+var mirrorLastSeenMutex sync.Mutex
+
+func setupHealth() {
+	var err error
+	MinFreeSpace, err = parseSize(getEnv("MIN_FREE_SPACE", "1GB"))
+	if err != nil {
+		exitWithError("Invalid MIN_FREE_SPACE", err)
+	}
+	UpstreamWindow, err = time.ParseDuration(getEnv("READY_UPSTREAM_WINDOW", "10m"))
+	if err != nil {
+		exitWithError("Invalid READY_UPSTREAM_WINDOW", err)
+	}
+}
+
+// parseSize reads sizes like "500MB", "1.5GB" or a plain number of bytes
+func parseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	units := []struct {
+		suffix string
+		factor float64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+	factor := 1.0
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			factor = unit.factor
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			break
+		}
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, errors.New("invalid size " + value)
+	}
+	return int64(number * factor), nil
+}
+
+// markMirrorSeen records that a mirror answered, whatever it answered
+func markMirrorSeen(link string) {
+	mirrorLastSeenMutex.Lock()
+	defer mirrorLastSeenMutex.Unlock()
+	mirrorLastSeen[link] = time.Now()
+}
+
+func upstreamSeenRecently() bool {
+	mirrorLastSeenMutex.Lock()
+	defer mirrorLastSeenMutex.Unlock()
+	for _, link := range ApiLink {
+		if time.Since(mirrorLastSeen[link]) < UpstreamWindow {
+			return true
+		}
+	}
+	return false
+}
+
+// ProbeTimeout caps how long a readiness probe waits for the mirrors, well within a kubelet's probe timeout
+var ProbeTimeout = 3 * time.Second
+
+var probeMutex sync.Mutex
+var lastProbe time.Time
+var lastProbeErr error
+
+// checkUpstream is fine if a mirror answered recently, otherwise it probes them. Concurrent readiness checks share
+// one probe, and a failed probe is reused for ProbeTimeout so they don't hammer mirrors that are down.
+func checkUpstream() error {
+	if upstreamSeenRecently() {
+		return nil
+	}
+	probeMutex.Lock()
+	defer probeMutex.Unlock()
+	if upstreamSeenRecently() {
+		return nil
+	}
+	if lastProbeErr != nil && time.Since(lastProbe) < ProbeTimeout {
+		return lastProbeErr
+	}
+	lastProbeErr = probeMirrors()
+	lastProbe = time.Now()
+	return lastProbeErr
+}
+
+// probeMirrors asks all mirrors for their index page at once, and is done when the first one answers
+func probeMirrors() error {
+	if len(ApiLink) == 0 {
+		return errors.New("no mirrors configured")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ProbeTimeout)
+	defer cancel()
+	results := make(chan error, len(ApiLink))
+	for _, link := range ApiLink {
+		go func() {
+			req, err := http.NewRequestWithContext(ctx, "GET", link+"/", nil)
+			if err != nil {
+				results <- err
+				return
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				results <- err
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 500 {
+				results <- errors.New(link + " answered " + resp.Status)
+				return
+			}
+			markMirrorSeen(link)
+			results <- nil
+		}()
+	}
+	var lastErr error
+	for range ApiLink {
+		if lastErr = <-results; lastErr == nil {
+			return nil
+		}
+	}
+	return lastErr
+}
+
+func checkWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".tidlarr-ready-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func checkFreeSpace() error {
+	free, _, err := diskSpaceOf(DownloadPath)
+	if err != nil {
+		return err
+	}
+	if int64(free) < MinFreeSpace {
+		return errors.New("only " + strconv.FormatUint(free>>20, 10) + " MB free")
+	}
+	return nil
+}
+
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func writeHealth(w http.ResponseWriter, checks map[string]error) {
+	resp := HealthResponse{Status: "ok", Checks: map[string]string{}}
+	status := http.StatusOK
+	for name, err := range checks {
+		if err != nil {
+			resp.Checks[name] = err.Error()
+			resp.Status = "fail"
+			status = http.StatusServiceUnavailable
+		} else {
+			resp.Checks[name] = "ok"
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleHealthz is the liveness probe: if we can answer, we're alive
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, map[string]error{})
+}
+
+// handleReadyz is the readiness probe: can we actually take and finish a grab right now
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]error{
+		"complete_dir":   checkWritable(filepath.Join(DownloadPath, "complete", Category)),
+		"incomplete_dir": checkWritable(filepath.Join(DownloadPath, "incomplete", Category)),
+		"free_space":     checkFreeSpace(),
+		"upstream":       checkUpstream(),
+		"shutdown":       nil,
+	}
+	//stop getting traffic while the workers drain
+	if stopping.Load() {
+		checks["shutdown"] = errors.New("shutting down")
+	}
+	writeHealth(w, checks)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func (p *testProxy) readiness(t *testing.T) (int, HealthResponse) {
+	t.Helper()
+	status, body := p.getStatus(t, "/readyz", url.Values{})
+	var health HealthResponse
+	if err := json.Unmarshal([]byte(body), &health); err != nil {
+		t.Fatalf("couldn't parse readiness %q: %v", body, err)
+	}
+	return status, health
+}
+
+// resetProbe forgets failed probes of earlier tests
+func resetProbe(t *testing.T) {
+	t.Helper()
+	probeMutex.Lock()
+	lastProbe, lastProbeErr = time.Time{}, nil
+	probeMutex.Unlock()
+}
+
+func TestHealthz(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	if status, _ := proxy.getStatus(t, "/healthz", url.Values{}); status != http.StatusOK {
+		t.Errorf("expected 200, got %d", status)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	resetProbe(t)
+	MinFreeSpace, UpstreamWindow = 0, time.Minute
+	t.Cleanup(func() { MinFreeSpace, UpstreamWindow = 0, 0 })
+
+	status, health := proxy.readiness(t)
+	if status != http.StatusOK {
+		t.Fatalf("expected ready, got %d %+v", status, health)
+	}
+	if proxy.Upstream.Hits("/") != 1 {
+		t.Error("with no recent upstream traffic the mirrors should be probed")
+	}
+	proxy.readiness(t)
+	if proxy.Upstream.Hits("/") != 1 {
+		t.Error("a mirror that answered recently shouldn't be probed again")
+	}
+
+	MinFreeSpace = 1 << 62
+	if status, health := proxy.readiness(t); status != http.StatusServiceUnavailable || health.Checks["free_space"] == "ok" {
+		t.Errorf("expected free space failure, got %d %+v", status, health)
+	}
+	MinFreeSpace = 0
+
+	os.RemoveAll(filepath.Join(DownloadPath, "incomplete"))
+	if status, health := proxy.readiness(t); status != http.StatusServiceUnavailable || health.Checks["incomplete_dir"] == "ok" {
+		t.Errorf("expected incomplete dir failure, got %d %+v", status, health)
+	}
+}
+
+func TestReadyzWithoutUpstream(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	resetProbe(t)
+	ApiLink = []string{"http://127.0.0.1:1"}
+	MinFreeSpace, UpstreamWindow = 0, time.Minute
+	t.Cleanup(func() { MinFreeSpace, UpstreamWindow = 0, 0 })
+	if status, health := proxy.readiness(t); status != http.StatusServiceUnavailable || health.Checks["upstream"] == "ok" {
+		t.Errorf("expected upstream failure, got %d %+v", status, health)
+	}
+}
+
+func TestReadyzDoesntWaitForSlowMirrors(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	resetProbe(t)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	t.Cleanup(slow.Close)
+	ApiLink = []string{slow.URL, slow.URL + "/other"}
+	MinFreeSpace, UpstreamWindow, ProbeTimeout = 0, time.Minute, 200*time.Millisecond
+	t.Cleanup(func() { MinFreeSpace, UpstreamWindow, ProbeTimeout = 0, 0, 3*time.Second })
+
+	start := time.Now()
+	if status, health := proxy.readiness(t); status != http.StatusServiceUnavailable || health.Checks["upstream"] == "ok" {
+		t.Errorf("expected upstream failure, got %d %+v", status, health)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("readiness waited %v for the mirrors", took)
+	}
+}
+
+func TestReadyzFailsWhileShuttingDown(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	resetProbe(t)
+	resetStopping(t)
+	MinFreeSpace, UpstreamWindow = 0, time.Minute
+	t.Cleanup(func() { MinFreeSpace, UpstreamWindow = 0, 0 })
+	markMirrorSeen(proxy.Upstream.URL)
+	drainWorkers(0)
+	if status, health := proxy.readiness(t); status != http.StatusServiceUnavailable || health.Checks["shutdown"] == "ok" {
+		t.Errorf("expected not ready while shutting down, got %d %+v", status, health)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for value, expected := range map[string]int64{"1GB": 1 << 30, "500 mb": 500 << 20, "1.5KB": 1536, "42": 42} {
+		if size, err := parseSize(value); err != nil || size != expected {
+			t.Errorf("parseSize(%q) = %d, %v, expected %d", value, size, err, expected)
+		}
+	}
+	if _, err := parseSize("lots"); err == nil {
+		t.Error("expected an error for garbage")
+	}
+}
@@ -2,8 +2,7 @@ package main
 
 import (
 	"encoding/xml"
-	"fmt"
-	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -17,6 +16,7 @@ type Album struct {
 	Artist       string
 	Title        string
 	Edition      string
+	Explicit     bool
 	ReleaseDate  string
 	Publisher    string
 	CoverUrl     string
@@ -32,36 +32,38 @@ type Album struct {
 func handleIndexerRequest(w http.ResponseWriter, r *http.Request) {
 	var queryApiKey string = r.URL.Query().Get("apikey")
 	if queryApiKey != ApiKey {
-		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
-		<error code="100" description="Incorrect user credentials"/>`))
+		newznabError(w, http.StatusUnauthorized, 100, "Incorrect user credentials")
 		return
 	}
 	switch query := r.URL.Query().Get("t"); query {
 	case "caps":
 		caps(w, *r.URL)
 	case "music":
-		music(w, *r.URL)
+		music(w, r)
 	case "search":
-		search(w, *r.URL)
+		search(w, r)
 	case "fakenzb":
 		fakenzb(w, *r.URL)
 	default:
-		fmt.Println("Indexer unknown request:")
-		fmt.Println(r.Method)
-		fmt.Println(r.URL.String())
-		fmt.Println(r.Header)
-		buffer := make([]byte, 100)
-		for {
-			n, err := r.Body.Read(buffer)
-			fmt.Printf("%q\n", buffer[:n])
-			if err == io.EOF {
-				break
-			}
-		}
-		w.Write([]byte("Request received!"))
+		slog.WarnContext(r.Context(), "Indexer unknown request", "method", r.Method, "url", redactUrl(r.URL), "user_agent", r.UserAgent())
+		newznabError(w, http.StatusBadRequest, 202, "No such function")
 	}
 }
 
+type NewznabError struct {
+	XMLName     xml.Name `xml:"error"`
+	Code        int      `xml:"code,attr"`
+	Description string   `xml:"description,attr"`
+}
+
+// newznabError answers with a Newznab error document, which Lidarr shows to the user and uses to back off the indexer
+func newznabError(w http.ResponseWriter, status int, code int, description string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(NewznabError{Code: code, Description: description})
+}
+
 func caps(w http.ResponseWriter, u url.URL) {
 	w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
 <caps>
@@ -72,7 +74,7 @@ func caps(w http.ResponseWriter, u url.URL) {
         <tv-search available="no" supportedParams=""/>
         <movie-search available="no" supportedParams=""/>
         <audio-search available="no" supportedParams=""/>
-        <music-search available="no" supportedParams=""/>
+        <music-search available="yes" supportedParams="q,artist,album"/>
     </searching>
     <categories>
         <category id="3000" name="Audio">
@@ -134,9 +136,17 @@ type NewznabAttr struct {
 	Value string `xml:"value,attr"`
 }
 
-func music(w http.ResponseWriter, u url.URL) {
+func music(w http.ResponseWriter, r *http.Request) {
+	u := r.URL
 	if u.Query().Get("q") == "" && u.Query().Get("artist") == "" && u.Query().Get("album") == "" {
-		fmt.Println("searching with no query, responding garbage...")
+		//Lidarr's RSS sync, answered with the followed artists' new releases once there are any
+		if feed := rssFeedAlbums(); len(feed) > 0 {
+			slog.DebugContext(r.Context(), "Searching with no query, responding with the RSS feed", "releases", len(feed))
+			w.Write([]byte(xml.Header))
+			xml.NewEncoder(w).Encode(albumsRss(preferVersions(feed)))
+			return
+		}
+		slog.DebugContext(r.Context(), "Searching with no query, responding garbage")
 		rss := Rss{
 			Version: "2.0",
 			Newznab: "http://www.newznab.com/DTD/2010/feeds/attributes/",
@@ -186,95 +196,141 @@ func music(w http.ResponseWriter, u url.URL) {
 	}
 	var queryUrl string = "/search/?al=" + url.QueryEscape(u.Query().Get("artist")) + "+" + url.QueryEscape(u.Query().Get("album"))
 	queryUrl = strings.Replace(queryUrl, " ", "+", -1)
-	
-	respondWithSearch(w, queryUrl)
+
+	respondWithSearch(w, r, queryUrl, searchQuery{Q: u.Query().Get("q"), Artist: u.Query().Get("artist"), Album: u.Query().Get("album")})
 }
 
-func search(w http.ResponseWriter, u url.URL) {
+func search(w http.ResponseWriter, r *http.Request) {
+	u := r.URL
 	//doing the actual querying request
 	//getting the query parameters
 	var query string = url.QueryEscape(u.Query().Get("q"))
 	//Searching with no query, probably Prowlarr testing the indexer. Returning same garbage as with t=music
 	if query == "" {
-		music(w, u)
+		music(w, r)
 		return
 	}
 	//Tidal API (sachinsenal0x64/hifi) doesn't support setting limit or offset as of right now. Just use the first and only 25 results
 	var queryUrl string = "/search/?al=" + query
-	respondWithSearch(w, queryUrl)
+	respondWithSearch(w, r, queryUrl, searchQuery{Q: u.Query().Get("q")})
 }
 
-func respondWithSearch(w http.ResponseWriter, queryUrl string) {
-	rss, err := buildSearchResponse(queryUrl)
+// respondWithSearch answers with the album search, plus the artist's discography when an artist is given
+func respondWithSearch(w http.ResponseWriter, r *http.Request, queryUrl string, query searchQuery) {
+	start := time.Now()
+	handler := r.URL.Query().Get("t")
+	rss, err := buildSearchResponse(queryUrl, query)
 	if err != nil {
-		// Log error, maybe return empty RSS?
-		fmt.Println("Error building search response:", err)
+		searchesTotal.inc(handler, "error")
+		searchDuration.observe(time.Since(start).Seconds(), handler, "error")
+		slog.ErrorContext(r.Context(), "Error building search response", "query", queryUrl, "error", err)
+		newznabError(w, http.StatusServiceUnavailable, 900, "Upstream search failed: "+err.Error())
 		return
 	}
+	searchesTotal.inc(handler, "ok")
+	searchDuration.observe(time.Since(start).Seconds(), handler, "ok")
+	slog.InfoContext(r.Context(), "Search", "query", queryUrl, "results", len(rss.Channel.Items), "duration", time.Since(start))
 	w.Write([]byte(xml.Header))
 	xml.NewEncoder(w).Encode(rss)
 }
 
 func releaseName(album Album) (name string) {
-	release := album.ReleaseDate[0:4]
-	if QualityId == "HIGH" {
-		name = album.Artist + "-" + album.Title + "-WEB-320-AAC-" + release + "-TIDLARR"
+	//discographies list some releases without a date, their name has no year
+	release := ""
+	if len(album.ReleaseDate) >= 4 {
+		release = "-" + album.ReleaseDate[0:4]
+	}
+	title := releaseTitle(album)
+	if Transcode != nil && Transcode.Lossless {
+		name = album.Artist + "-" + title + "-" + strconv.FormatInt(album.BitDepth, 10) + "BIT-" + strconv.FormatInt(album.SamplingRate, 10) + "-KHZ-" + Transcode.Release + release + "-TIDLARR"
+	} else if Transcode != nil {
+		name = album.Artist + "-" + title + "-" + Transcode.Release + release + "-TIDLARR"
+	} else if QualityId == "HIGH" {
+		name = album.Artist + "-" + title + "-WEB-320-AAC" + release + "-TIDLARR"
 	} else {
-		name = album.Artist + "-" + album.Title + "-" + strconv.FormatInt(album.BitDepth, 10) + "BIT-" + strconv.FormatInt(album.SamplingRate, 10) + "-KHZ-WEB-FLAC-" + release + "-TIDLARR"
+		name = album.Artist + "-" + title + "-" + strconv.FormatInt(album.BitDepth, 10) + "BIT-" + strconv.FormatInt(album.SamplingRate, 10) + "-KHZ-WEB-FLAC" + release + "-TIDLARR"
 	}
 	return name
 }
 
-func buildSearchResponse(queryUrl string) (*Rss, error) {
+// estimateSize guesses how big an album ends up in format, nil for the files Tidal sends
+func estimateSize(album Album, format *outputFormat) int64 {
+	if format != nil && !format.Lossless {
+		// lossy output, estimated from the encoder's average bitrate
+		return int64(format.Bitrate) * 1000 * album.Duration / 8
+	}
+	if QualityId == "HIGH" && format == nil {
+		// AAC 320kbps estimate
+		return 320 * 1000 * album.Duration / 8
+	}
+	// FLAC (default)
+	return int64(float64(((album.SamplingRate * 1000) * (album.BitDepth * album.Channels * album.Duration) / 8)) * 0.7)
+}
+
+// searchAlbums runs a search upstream and reads the albums it found
+func searchAlbums(queryUrl string) ([]Album, error) {
 	bodyBytes, err := request(queryUrl)
 	if err != nil {
 		return nil, err
 	}
 	var Albums []Album
 	//iterate over each album and create an Album struct object from it
-	result := gjson.Get(bodyBytes, "data.albums.items")
-	result.ForEach(func(key, value gjson.Result) bool {
-		var album Album
-		var resultString string = value.String()
-		album.Artist = gjson.Get(resultString, "artists.0.name").String()
-		album.Title = gjson.Get(resultString, "title").String()
-		album.Edition = gjson.Get(resultString, "version").String()
-		album.ReleaseDate = gjson.Get(resultString, "releaseDate").String()
-		album.Publisher = gjson.Get(resultString, "copyright").String()
-		album.Id = gjson.Get(resultString, "id").String()
-		album.NumTracks = gjson.Get(resultString, "numberOfTracks").Int()
-		//Assuming Stereo, 16 bit and 44.1KHz because checking this would take a lot more api calls
-		//Also skipping cover art url because we can just grab that later
-		album.Channels = 2
-		album.SamplingRate = 44
-		album.BitDepth = 16
-		album.Duration = gjson.Get(resultString, "duration").Int()
-		
-		if QualityId == "HIGH" {
-			// AAC 320kbps estimate
-			album.Size = int64(320 * 1000 * album.Duration / 8)
-		} else {
-			// FLAC (default)
-			album.Size = int64(float64(((album.SamplingRate * 1000) * (album.BitDepth * album.Channels * album.Duration) / 8)) * 0.7)
-		}
-		
-		Albums = append(Albums, album)
-
+	gjson.Get(bodyBytes, "data.albums.items").ForEach(func(key, value gjson.Result) bool {
+		Albums = append(Albums, parseAlbum(value))
 		return true // keep iterating
 	})
+	return Albums, nil
+}
+
+// parseAlbum reads an album as upstream lists it in searches and discographies
+func parseAlbum(value gjson.Result) Album {
+	var album Album
+	var resultString string = value.String()
+	album.Artist = gjson.Get(resultString, "artists.0.name").String()
+	album.Title = gjson.Get(resultString, "title").String()
+	album.Edition = gjson.Get(resultString, "version").String()
+	album.Explicit = gjson.Get(resultString, "explicit").Bool()
+	album.ReleaseDate = gjson.Get(resultString, "releaseDate").String()
+	album.Publisher = gjson.Get(resultString, "copyright").String()
+	album.Id = gjson.Get(resultString, "id").String()
+	album.NumTracks = gjson.Get(resultString, "numberOfTracks").Int()
+	//Assuming Stereo, 16 bit and 44.1KHz because checking this would take a lot more api calls
+	//Also skipping cover art url because we can just grab that later
+	album.Channels = 2
+	album.SamplingRate = 44
+	album.BitDepth = 16
+	album.Duration = gjson.Get(resultString, "duration").Int()
+
+	album.Size = estimateSize(album, Transcode)
+	return album
+}
+
+func buildSearchResponse(queryUrl string, query searchQuery) (*Rss, error) {
+	Albums, err := searchMusic(queryUrl, query.Artist, query.Album)
+	if err != nil {
+		return nil, err
+	}
+	ranked := rankAlbums(query, Albums)
+	if len(ranked) < len(Albums) {
+		slog.Debug("Dropped search results not matching the query", "query", queryUrl, "dropped", len(Albums)-len(ranked))
+	}
+	return albumsRss(preferVersions(ranked)), nil
+}
 
+// albumsRss lists albums as Newznab results
+func albumsRss(Albums []Album) *Rss {
 	items := []Item{}
 	for _, album := range Albums {
 		// Removed regex sanitization of album.Title and album.Artist
-		
+
 		timestamp, _ := time.Parse("2006-01-02", album.ReleaseDate)
 		Release := releaseName(album)
 
 		var categoryName string
 		var categoryAttrs []NewznabAttr
 
-		if QualityId == "HIGH" {
-			// AAC 320
+		if outputLossy() {
+			// AAC 320, or transcoded to a lossy format
 			categoryName = "Audio > MP3"
 			categoryAttrs = []NewznabAttr{
 				{Name: "category", Value: "3000"},
@@ -291,16 +347,21 @@ func buildSearchResponse(queryUrl string) (*Rss, error) {
 			}
 		}
 
+		if album.Edition != "" {
+			categoryAttrs = append(categoryAttrs, NewznabAttr{Name: "edition", Value: album.Edition})
+		}
+		categoryAttrs = append(categoryAttrs, NewznabAttr{Name: "explicit", Value: strconv.FormatBool(album.Explicit)})
+
 		items = append(items, Item{
-			Title: Release,
-			Guid: Guid{IsPermaLink: true, Value: "http://www.tidal.com/album?id=" + album.Id},
-			Link: "http://www.tidal.com/album/" + album.Id,
-			Comments: "http://www.tidal.com/album/" + album.Id + "#comments",
-			PubDate: timestamp.Format("Mon, 02 Jan 2006 15:04:05 -0700"),
-			Category: categoryName,
+			Title:       Release,
+			Guid:        Guid{IsPermaLink: true, Value: "http://www.tidal.com/album?id=" + album.Id},
+			Link:        "http://www.tidal.com/album/" + album.Id,
+			Comments:    "http://www.tidal.com/album/" + album.Id + "#comments",
+			PubDate:     timestamp.Format("Mon, 02 Jan 2006 15:04:05 -0700"),
+			Category:    categoryName,
 			Description: album.Artist + " " + album.Title,
 			Enclosure: Enclosure{
-				Url: "/indexer?t=fakenzb&name=" + url.QueryEscape(Release) + "&tidalid=" + album.Id + "&numtracks=" + strconv.FormatInt(album.NumTracks, 10) + "&apikey=" + ApiKey,
+				Url:  "/indexer?t=fakenzb&name=" + url.QueryEscape(Release) + "&tidalid=" + album.Id + "&numtracks=" + strconv.FormatInt(album.NumTracks, 10) + "&apikey=" + ApiKey,
 				Type: "application/x-nzb",
 			},
 			Attrs: categoryAttrs,
@@ -321,12 +382,16 @@ func buildSearchResponse(queryUrl string) (*Rss, error) {
 		},
 	}
 
-	return &rss, nil
+	return &rss
 }
 
 func fakenzb(w http.ResponseWriter, u url.URL) {
 	TidalID := u.Query().Get("tidalid")
 	NumTracks := u.Query().Get("numtracks")
+	if TidalID == "" {
+		newznabError(w, http.StatusBadRequest, 200, "Missing parameter (tidalid)")
+		return
+	}
 	w.Header().Set("Content-Type", "application/x-nzb")
 	response := "<?xml version=\"1.0\" encoding=\"UTF-8\" ?>\n" +
 		"<!DOCTYPE nzb PUBLIC \"-//newzBin//DTD NZB 1.0//EN\" \"http://www.newzbin.com/DTD/nzb/nzb-1.0.dtd\">\n" +
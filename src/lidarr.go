@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With LIDARR_URL and LIDARR_API_KEY set, every completed album is handed to Lidarr's DownloadedAlbumsScan right
+// away instead of waiting for Lidarr's next poll. The command is followed until it finishes, and if the album is
+// still in complete/ afterwards Lidarr's reasons for rejecting it are written to the history entry.
+// LIDARR_DOWNLOAD_PATH is where Lidarr sees DOWNLOAD_PATH, if its volumes are mounted elsewhere.
+
+var LidarrUrl string
+var LidarrApiKey string
+var LidarrDownloadPath string
+var lidarrPollInterval = 2 * time.Second
+var lidarrCommandTimeout = 30 * time.Minute
+
+// import states shown in the history
+const (
+	ImportRunning  = "Running"
+	ImportImported = "Imported"
+	ImportRejected = "Rejected"
+	ImportFailed   = "Failed"
+)
+
+type lidarrCommand struct {
+	Id      int    `json:"id"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+type lidarrManualImport struct {
+	Path       string `json:"path"`
+	Rejections []struct {
+		Reason string `json:"reason"`
+	} `json:"rejections"`
+}
+
+func setupLidarr() {
+	LidarrUrl = strings.TrimSuffix(getEnv("LIDARR_URL", ""), "/")
+	LidarrApiKey = getEnv("LIDARR_API_KEY", "")
+	LidarrDownloadPath = getEnv("LIDARR_DOWNLOAD_PATH", "")
+	if LidarrUrl == "" {
+		return
+	}
+	if LidarrApiKey == "" {
+		exitWithError("Invalid Lidarr settings", errors.New("LIDARR_API_KEY is needed with LIDARR_URL"))
+	}
+	if _, err := url.ParseRequestURI(LidarrUrl); err != nil {
+		exitWithError("Invalid LIDARR_URL", err)
+	}
+	slog.Info("Lidarr imports enabled", "lidarr", mirrorLabel(LidarrUrl))
+}
+
+// lidarrPath turns a path below DOWNLOAD_PATH into the one Lidarr sees
+func lidarrPath(path string) string {
+	if LidarrDownloadPath == "" {
+		return path
+	}
+	relative, err := filepath.Rel(DownloadPath, path)
+	if err != nil {
+		return path
+	}
+	//Lidarr might run on another OS, keep its separators
+	separator := "/"
+	if strings.Contains(LidarrDownloadPath, `\`) {
+		separator = `\`
+	}
+	return strings.TrimRight(LidarrDownloadPath, `/\`) + separator + strings.ReplaceAll(relative, string(filepath.Separator), separator)
+}
+
+// lidarrRequest calls Lidarr's API, decoding the answer into result
+func lidarrRequest(method string, path string, body any, result any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, LidarrUrl+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Api-Key", LidarrApiKey)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Lidarr answered %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// setImportStatus records how the import went, in the manifest too unless it's still running or the album was
+// imported and its folder is gone
+func setImportStatus(download *Download, status string, message string) {
+	DownloadsMutex.Lock()
+	download.importStatus = status
+	download.importMessage = message
+	folder := filepath.Join(DownloadPath, "complete", Category, download.FileName)
+	DownloadsMutex.Unlock()
+	if status == ImportRunning {
+		return
+	}
+	err := updateManifest(folder, func(manifest *AlbumManifest) {
+		manifest.ImportStatus, manifest.ImportMessage = status, message
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("Couldn't save the import status in the album manifest", "nzo_id", "SABnzbd_nzo_"+download.Id, "error", err)
+	}
+}
+
+// triggerImport asks Lidarr to import a completed album and follows the command until it's done. The job shows as
+// running meanwhile.
+func triggerImport(download *Download) {
+	if LidarrUrl == "" {
+		return
+	}
+	DownloadsMutex.Lock()
+	Id, folder := download.Id, filepath.Join(DownloadPath, "complete", Category, download.FileName)
+	DownloadsMutex.Unlock()
+	log := slog.With("nzo_id", "SABnzbd_nzo_"+Id, "album_id", Id)
+
+	var command lidarrCommand
+	err := lidarrRequest(http.MethodPost, "/api/v1/command", map[string]any{
+		"name":             "DownloadedAlbumsScan",
+		"path":             lidarrPath(folder),
+		"downloadClientId": "SABnzbd_nzo_" + Id,
+		"importMode":       "Move",
+	}, &command)
+	if err != nil {
+		log.Warn("Couldn't ask Lidarr to import the album", "error", err)
+		setImportStatus(download, ImportFailed, err.Error())
+		return
+	}
+	log.Info("Asked Lidarr to import the album", "command_id", command.Id)
+
+	deadline := time.Now().Add(lidarrCommandTimeout)
+	for !commandFinished(command.Status) {
+		if time.Now().After(deadline) {
+			setImportStatus(download, ImportFailed, "Lidarr's import didn't finish within "+lidarrCommandTimeout.String())
+			return
+		}
+		time.Sleep(lidarrPollInterval)
+		if err := lidarrRequest(http.MethodGet, "/api/v1/command/"+strconv.Itoa(command.Id), nil, &command); err != nil {
+			log.Warn("Couldn't follow Lidarr's import", "command_id", command.Id, "error", err)
+			setImportStatus(download, ImportFailed, err.Error())
+			return
+		}
+	}
+	if command.Status != "completed" {
+		message := "Lidarr's import " + command.Status
+		if command.Message != "" {
+			message += ": " + command.Message
+		}
+		log.Warn("Lidarr's import didn't complete", "command_id", command.Id, "status", command.Status, "message", command.Message)
+		setImportStatus(download, ImportFailed, message)
+		return
+	}
+
+	if !hasAudioFiles(folder) {
+		log.Info("Lidarr imported the album")
+		setImportStatus(download, ImportImported, "")
+		return
+	}
+	reasons, err := importRejections(folder, Id)
+	if err != nil {
+		log.Warn("Couldn't ask Lidarr why the album wasn't imported", "error", err)
+		reasons = []string{"Lidarr didn't import the album"}
+	}
+	log.Warn("Lidarr didn't import the album", "reasons", reasons)
+	addWarning("SABnzbd_nzo_"+Id, "Lidarr didn't import "+filepath.Base(folder)+": "+strings.Join(reasons, "; "))
+	setImportStatus(download, ImportRejected, strings.Join(reasons, "; "))
+}
+
+func commandFinished(status string) bool {
+	switch status {
+	case "completed", "failed", "aborted", "cancelled", "orphaned":
+		return true
+	}
+	return false
+}
+
+// hasAudioFiles reports whether any track is still below folder
+func hasAudioFiles(folder string) bool {
+	found := false
+	filepath.WalkDir(folder, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() && isAudioFile(entry.Name()) {
+			found = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return found
+}
+
+// importRejections asks Lidarr's manual import why the tracks in folder can't be imported
+func importRejections(folder string, Id string) ([]string, error) {
+	query := url.Values{"folder": {lidarrPath(folder)}, "downloadId": {"SABnzbd_nzo_" + Id}, "filterExistingFiles": {"true"}}
+	var items []lidarrManualImport
+	if err := lidarrRequest(http.MethodGet, "/api/v1/manualimport?"+query.Encode(), nil, &items); err != nil {
+		return nil, err
+	}
+	var reasons []string
+	seen := map[string]bool{}
+	for _, item := range items {
+		for _, rejection := range item.Rejections {
+			if !seen[rejection.Reason] {
+				seen[rejection.Reason] = true
+				reasons = append(reasons, rejection.Reason)
+			}
+		}
+	}
+	if len(reasons) == 0 {
+		return []string{"Lidarr didn't import the album and gave no reason"}, nil
+	}
+	return reasons, nil
+}
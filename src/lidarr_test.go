@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLidarr answers the import command. With importing set it moves the album away like a successful import,
+// otherwise it leaves it and rejects it.
+type fakeLidarr struct {
+	*httptest.Server
+	mu        sync.Mutex
+	importing bool
+	scanned   map[string]any
+	// the job's status when the scan was asked for
+	statusAtScan string
+	polls        int
+	// albums served by wanted/missing and wanted/cutoff
+	wanted map[string][]map[string]any
+	// served by the artist list
+	artists []map[string]any
+}
+
+func useLidarr(t *testing.T, importing bool) *fakeLidarr {
+	t.Helper()
+	lidarr := &fakeLidarr{importing: importing, wanted: map[string][]map[string]any{}}
+	lidarr.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "lidarr-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		lidarr.mu.Lock()
+		defer lidarr.mu.Unlock()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v1/command":
+			json.NewDecoder(r.Body).Decode(&lidarr.scanned)
+			if download, ok := getDownload(strings.TrimPrefix(lidarr.scanned["downloadClientId"].(string), "SABnzbd_nzo_")); ok {
+				DownloadsMutex.Lock()
+				lidarr.statusAtScan = download.Status
+				DownloadsMutex.Unlock()
+			}
+			writeJson(w, map[string]any{"id": 7, "status": "queued"})
+		case r.URL.Path == "/api/v1/command/7":
+			lidarr.polls++
+			if lidarr.polls < 2 {
+				writeJson(w, map[string]any{"id": 7, "status": "started"})
+				return
+			}
+			if lidarr.importing {
+				os.RemoveAll(lidarr.scanned["path"].(string))
+			}
+			writeJson(w, map[string]any{"id": 7, "status": "completed", "message": "Completed"})
+		case strings.HasPrefix(r.URL.Path, "/api/v1/wanted/"):
+			records := lidarr.wanted[strings.TrimPrefix(r.URL.Path, "/api/v1/wanted/")]
+			page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+			size, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+			from, to := min((page-1)*size, len(records)), min(page*size, len(records))
+			writeJson(w, map[string]any{"page": page, "pageSize": size, "totalRecords": len(records), "records": records[from:to]})
+		case r.URL.Path == "/api/v1/artist":
+			writeJson(w, append([]map[string]any{}, lidarr.artists...))
+		case r.URL.Path == "/api/v1/manualimport":
+			writeJson(w, []map[string]any{
+				{"path": r.URL.Query().Get("folder") + "/01.flac", "rejections": []map[string]any{{"reason": "Album match is not close enough", "type": "permanent"}}},
+				{"path": r.URL.Query().Get("folder") + "/02.flac", "rejections": []map[string]any{{"reason": "Album match is not close enough", "type": "permanent"}}},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(lidarr.Close)
+	oldUrl, oldKey, oldPath, oldInterval := LidarrUrl, LidarrApiKey, LidarrDownloadPath, lidarrPollInterval
+	t.Cleanup(func() {
+		LidarrUrl, LidarrApiKey, LidarrDownloadPath, lidarrPollInterval = oldUrl, oldKey, oldPath, oldInterval
+	})
+	LidarrUrl, LidarrApiKey, LidarrDownloadPath = lidarr.URL, "lidarr-key", ""
+	lidarrPollInterval = 10 * time.Millisecond
+	return lidarr
+}
+
+func waitForImport(t *testing.T, proxy *testProxy, nzoId string) HistorySlot {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, slot := range proxy.history(t, url.Values{}).History.Slots {
+			if slot.NzoId == nzoId && slot.ImportStatus != "" && slot.ImportStatus != ImportRunning {
+				return slot
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("import of %s never finished", nzoId)
+	return HistorySlot{}
+}
+
+func TestCompletedAlbumIsImported(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	lidarr := useLidarr(t, true)
+	item := findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Red Bar"}}), "Red Bar")
+	nzoId := proxy.grab(t, item)
+	slot := waitForImport(t, proxy, nzoId)
+	if slot.ImportStatus != ImportImported || slot.ImportMessage != "" {
+		t.Errorf("expected the album to be imported, got %+v", slot)
+	}
+	lidarr.mu.Lock()
+	defer lidarr.mu.Unlock()
+	if lidarr.scanned["name"] != "DownloadedAlbumsScan" || lidarr.scanned["path"] != slot.Storage || lidarr.scanned["downloadClientId"] != nzoId {
+		t.Errorf("unexpected command %v", lidarr.scanned)
+	}
+	if lidarr.statusAtScan != StatusRunning {
+		t.Errorf("Lidarr shouldn't see the job completed before the scan, it was %q", lidarr.statusAtScan)
+	}
+}
+
+func TestImportRejectionIsKept(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	useLidarr(t, false)
+	nzoId := proxy.grab(t, findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Green Bar"}}), "Green Bar"))
+	slot := waitForImport(t, proxy, nzoId)
+	if slot.Status != "Completed" || slot.ImportStatus != ImportRejected || slot.ImportMessage != "Album match is not close enough" {
+		t.Errorf("expected Lidarr's rejection in the history, got %+v", slot)
+	}
+
+	restart(t)
+	if slots := proxy.history(t, url.Values{}).History.Slots; len(slots) != 1 || slots[0].ImportStatus != ImportRejected || slots[0].ImportMessage != slot.ImportMessage {
+		t.Errorf("import status lost after a restart: %+v", slots)
+	}
+}
+
+func TestImportWithWrongApiKey(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	useLidarr(t, true)
+	LidarrApiKey = "wrong"
+	nzoId := proxy.grab(t, findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Red Bar"}}), "Red Bar"))
+	if slot := waitForImport(t, proxy, nzoId); slot.ImportStatus != ImportFailed {
+		t.Errorf("a refused command should show as failed, got %+v", slot)
+	}
+}
+
+func TestLidarrPath(t *testing.T) {
+	oldDownloadPath, oldLidarrPath := DownloadPath, LidarrDownloadPath
+	t.Cleanup(func() { DownloadPath, LidarrDownloadPath = oldDownloadPath, oldLidarrPath })
+	DownloadPath = "/data/tidlarr"
+	LidarrDownloadPath = `D:\downloads\tidlarr\`
+	if path := lidarrPath("/data/tidlarr/complete/music/Album-TIDLARR"); path != `D:\downloads\tidlarr\complete\music\Album-TIDLARR` {
+		t.Errorf("unexpected path %q", path)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+type contextKey string
+
+const requestIdKey contextKey = "request_id"
+
+// query parameters that must never end up in the logs
+var secretParams = []string{"apikey", "api_key", "token"}
+
+func setupLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(getEnv("LOG_LEVEL", "info"))); err != nil {
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if strings.EqualFold(getEnv("LOG_FORMAT", "text"), "json") {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	}
+	slog.SetDefault(slog.New(requestIdHandler{handler}))
+}
+
+// requestIdHandler adds the request_id of the HTTP request being served to every record logged with its context
+type requestIdHandler struct {
+	slog.Handler
+}
+
+func (h requestIdHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id, ok := ctx.Value(requestIdKey).(string); ok {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIdHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIdHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIdHandler) WithGroup(name string) slog.Handler {
+	return requestIdHandler{h.Handler.WithGroup(name)}
+}
+
+// redactUrl returns the URL as a string with API keys and tokens replaced, so it's safe to log
+func redactUrl(u *url.URL) string {
+	redacted := *u
+	redacted.RawQuery = redactQuery(redacted.Query()).Encode()
+	return redacted.String()
+}
+
+// redactQuery replaces secret parameters, including those of URLs passed as a value, like addurl's nzb link
+func redactQuery(query url.Values) url.Values {
+	for param, values := range query {
+		for i, value := range values {
+			if isSecretParam(param) {
+				values[i] = "REDACTED"
+			} else if link, err := url.Parse(value); err == nil && link.Scheme != "" && link.RawQuery != "" {
+				values[i] = redactUrl(link)
+			}
+		}
+	}
+	return query
+}
+
+func isSecretParam(param string) bool {
+	for _, secret := range secretParams {
+		if strings.EqualFold(param, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// logRequests tags each request with an ID and logs it once it's been answered
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := make([]byte, 6)
+		rand.Read(b)
+		ctx := context.WithValue(r.Context(), requestIdKey, hex.EncodeToString(b))
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		slog.DebugContext(ctx, "Handled request",
+			"method", r.Method,
+			"url", redactUrl(r.URL),
+			"status", recorder.status,
+			"duration", time.Since(start))
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRedactUrl(t *testing.T) {
+	u, _ := url.Parse("http://localhost:8688/indexer?t=search&q=abc&apikey=hunter2")
+	redacted := redactUrl(u)
+	if strings.Contains(redacted, "hunter2") {
+		t.Errorf("api key leaked: %s", redacted)
+	}
+	if !strings.Contains(redacted, "q=abc") || !strings.Contains(redacted, "apikey=REDACTED") {
+		t.Errorf("unexpected redaction %s", redacted)
+	}
+	if u.Query().Get("apikey") != "hunter2" {
+		t.Error("redactUrl shouldn't modify the original URL")
+	}
+}
+
+// lockedBuffer collects logs written by the workers while the test reads them
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAddurlLogsNoApiKey(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	var logs lockedBuffer
+	old := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(old) })
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	item := findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Green Bar"}}), "Green Bar")
+	nzbUrl := proxy.URL + item.Enclosure.Url
+	proxy.get(t, "/downloader/api", url.Values{"mode": {"addurl"}, "name": {nzbUrl}, "nzbname": {item.Title}, "cat": {"music"}})
+	proxy.get(t, "/downloader/api", url.Values{"mode": {"nonsense"}, "name": {nzbUrl}})
+	slog.SetDefault(old)
+	proxy.waitForHistory(t, "SABnzbd_nzo_1001")
+
+	if strings.Contains(logs.String(), testApiKey) {
+		t.Errorf("api key inside the nzb link leaked:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "apikey%3DREDACTED") {
+		t.Errorf("expected the nzb link's apikey redacted:\n%s", logs.String())
+	}
+}
@@ -1,22 +1,26 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"io"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
 var DownloadPath string
 var Category string
 var Port string
-var ApiLink = [...]string{"https://triton.squid.wtf", "https://tidal.kinoplus.online", "https://tidal-api.binimum.org", "https://hund.qqdl.site", "https://katze.qqdl.site", "https://maus.qqdl.site", "https://vogel.qqdl.site", "https://wolf.qqdl.site"}
+var ApiLink = []string{"https://triton.squid.wtf", "https://tidal.kinoplus.online", "https://tidal-api.binimum.org", "https://hund.qqdl.site", "https://katze.qqdl.site", "https://maus.qqdl.site", "https://vogel.qqdl.site", "https://wolf.qqdl.site"}
+var ImageHost = "https://resources.tidal.com"
 var ApiKey string
 var QualityId string
 var FileExtension string
@@ -34,8 +38,65 @@ func main() {
 	Category = getEnv("CATEGORY", "music")
 	Port = getEnv("PORT", "8688")
 	ApiKey = getEnv("API_KEY", "")
+	setupLogging()
 
-	quality := getEnv("QUALITY", "flac")
+	setQuality(getEnv("QUALITY", "flac"))
+	setupRateLimits()
+	setupBandwidth()
+	setupWorkers()
+	setupHealth()
+	setupDiskQuota()
+	setupShutdown()
+	setupTranscode()
+	setupVerify()
+	setupReplayGain()
+	setupNaming()
+	setupSearchRanking()
+	setupEditions()
+	setupScripts()
+	setupWebhooks()
+	setupLidarr()
+	setupWantedSync()
+	setupRssFeed()
+	if err := createFolders(); err != nil {
+		exitWithError("Couldn't create download folders", err)
+	}
+	checkpoint := loadCheckpoint()
+	cleanIncomplete(checkpoint)
+	cleanInterruptedMoves()
+	loadStats()
+	restoreHistory()
+	resumeJobs(checkpoint)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	server := &http.Server{Addr: ":" + Port, Handler: routes()}
+	go func() {
+		slog.Info("Listening on port " + Port)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			exitWithError("HTTP server stopped", err)
+		}
+	}()
+	<-ctx.Done()
+	shutdown(server)
+}
+
+func exitWithError(message string, err error) {
+	slog.Error(message, "error", err)
+	os.Exit(1)
+}
+
+func routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/indexer", handleIndexerRequest)
+	mux.HandleFunc("/downloader/api", handleDownloaderRequest)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	return logRequests(mux)
+}
+
+func setQuality(quality string) {
 	if quality == "aac-320" {
 		QualityId = "HIGH"
 		FileExtension = ".m4a"
@@ -43,89 +104,150 @@ func main() {
 		QualityId = "LOSSLESS" // or HI_RES
 		FileExtension = ".flac"
 	}
+}
 
-	//create folders if they don't exist yet
-	os.Mkdir(DownloadPath, 0775)
-	os.Mkdir(filepath.Join(DownloadPath, "incomplete"), 0775)
-	os.Mkdir(filepath.Join(DownloadPath, "incomplete", Category), 0775)
-	os.Mkdir(filepath.Join(DownloadPath, "complete"), 0775)
-	os.Mkdir(filepath.Join(DownloadPath, "complete", Category), 0775)
+// create folders if they don't exist yet
+func createFolders() error {
+	for _, folder := range []string{
+		DownloadPath,
+		filepath.Join(DownloadPath, "incomplete"),
+		filepath.Join(DownloadPath, "incomplete", Category),
+		filepath.Join(DownloadPath, "complete"),
+		filepath.Join(DownloadPath, "complete", Category),
+	} {
+		if err := os.Mkdir(folder, 0775); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
+}
 
-	//and now clear anything in /incomplete that was created by tidlarr. Likely a leftover failed download
+// clear anything in /incomplete that was created by tidlarr, except jobs we're about to resume. Likely a leftover failed download
+func cleanIncomplete(checkpoint []checkpointJob) {
+	resuming := map[string]bool{}
+	for _, job := range checkpoint {
+		resuming[job.FileName] = true
+	}
 	folders, err := os.ReadDir(filepath.Join(DownloadPath, "incomplete", Category))
 	if err != nil {
-		fmt.Println("Couldn't read incomplete folder: ")
-		fmt.Println(err)
+		slog.Error("Couldn't read incomplete folder", "error", err)
 	}
 	for _, folder := range folders {
-		if strings.Contains(folder.Name(), "-TIDLARR") {
-			fmt.Println("Removing incomplete download " + folder.Name())
+		if strings.Contains(folder.Name(), "-TIDLARR") && !resuming[folder.Name()] {
+			slog.Info("Removing incomplete download", "folder", folder.Name())
 			err := os.RemoveAll(filepath.Join(DownloadPath, "incomplete", Category, folder.Name()))
 			if err != nil {
-				fmt.Println("Failed to remove folder!")
-				fmt.Println(err)
+				slog.Error("Failed to remove folder", "folder", folder.Name(), "error", err)
 			}
 		}
 	}
+}
 
-	// Generate a basic list of downloads from folders in /complete. likely from completed downloads that weren't imported before reboot.
-	// Adding these to the downloads list allows importing/deleting from Lidarr
-	folders, _ = os.ReadDir(filepath.Join(DownloadPath, "complete", Category))
+// Generate a list of downloads from folders in /complete. likely from completed downloads that weren't imported before reboot.
+// Adding these to the downloads list with their original nzo_id allows importing/deleting from Lidarr
+func restoreHistory() {
+	folders, _ := os.ReadDir(filepath.Join(DownloadPath, "complete", Category))
 	for _, folder := range folders {
-		if strings.Contains(folder.Name(), "-TIDLARR") {
-			fmt.Println("Adding completed download " + folder.Name() + " to history")
-			var download Download
-			download.FileName = folder.Name()
-			//Don't really care about this anymore, but making sure they're equal so they show up in the history, not the queue
-			download.numTracks = 1
-			download.downloaded = 1
+		if !folder.IsDir() || !strings.Contains(folder.Name(), "-TIDLARR") {
+			continue
+		}
+		path := filepath.Join(DownloadPath, "complete", Category, folder.Name())
+		manifest, err := readManifest(path)
+		if err != nil {
+			manifest, err = manifestFromTags(path)
+		}
+		var download Download
+		download.FileName = folder.Name()
+		download.Id = manifest.Id
+		download.Artist = manifest.Artist
+		download.Album = manifest.Album
+		download.numTracks = max(manifest.NumTracks, 1)
+		//making sure they're equal so they show up in the history, not the queue
+		download.downloaded = download.numTracks
+		download.Status = StatusCompleted
+		download.added = manifest.Completed
+		download.scriptLog = manifest.ScriptLog
+		download.importStatus, download.importMessage = manifest.ImportStatus, manifest.ImportMessage
+		if info, infoErr := folder.Info(); download.added.IsZero() && infoErr == nil {
+			download.added = info.ModTime()
+		}
+		if err != nil {
 			//Can't know the exact ID anymore, but all it's needed for now is as a NZO_ID so generating a random one...
+			slog.Warn("Couldn't recover the Tidal album ID", "folder", folder.Name(), "error", err)
 			b := make([]byte, 13)
 			for i := range b {
 				b[i] = byte(rand.Intn(27) + 65)
 			}
 			download.Id = string(b)
+		}
+		slog.Info("Adding completed download to history", "folder", folder.Name(), "nzo_id", "SABnzbd_nzo_"+download.Id, "album_id", manifest.Id)
+		DownloadsMutex.Lock()
+		if existing, ok := Downloads[download.Id]; ok {
+			//the same album downloaded twice, the newer folder is the one Lidarr would have
+			kept, dropped := &download, existing
+			if existing.added.After(download.added) {
+				kept, dropped = existing, &download
+			}
+			slog.Warn("Two folders hold the same album, keeping the newer one", "album_id", download.Id, "kept", kept.FileName, "dropped", dropped.FileName)
+			Downloads[download.Id] = kept
+		} else {
 			Downloads[download.Id] = &download
 		}
+		DownloadsMutex.Unlock()
 	}
-
-	http.HandleFunc("/indexer", handleIndexerRequest)
-	http.HandleFunc("/downloader/api", handleDownloaderRequest)
-	fmt.Println("Listening on port " + Port + "...")
-	http.ListenAndServe(":"+Port, nil)
 }
 
 func request(query string) (string, error) {
 	var offset int = rand.Intn(len(ApiLink))
+	var lastStatus string = "no response"
 	client := &http.Client{}
 	for tries := 0; tries < len(ApiLink)*3; tries++ {
-		link := ApiLink[(tries+offset)%len(ApiLink)]
-		//fmt.Println("Trying URL " + link + query)
+		link := pickMirror(tries + offset)
+		throttle(link)
 		req, err := http.NewRequest("GET", link+query, nil)
 		if err != nil {
-			fmt.Println("Error creating request for " + link + query)
-			fmt.Println(err)
+			slog.Error("Error creating request", "mirror", link, "query", query, "error", err)
 			continue
 		}
 		req.Header.Add("X-Client", "tidlarr-proxy")
+		start := time.Now()
 		resp, err := client.Do(req)
+		upstreamDuration.observe(time.Since(start).Seconds(), mirrorLabel(link))
 		if err != nil {
-			fmt.Println(err)
+			upstreamRequestsTotal.inc(mirrorLabel(link), "error")
+			countMirrorRequest(link, 0, err.Error())
+			slog.Warn("Upstream request failed", "mirror", link, "query", query, "duration", time.Since(start), "error", err)
 			return "", err
 		}
+		upstreamRequestsTotal.inc(mirrorLabel(link), strconv.Itoa(resp.StatusCode))
+		markMirrorSeen(link)
 		defer resp.Body.Close()
 		//making the request body usable
 		bodyBytes, err := io.ReadAll(resp.Body)
 		if err != nil {
-			fmt.Println(err)
+			slog.Warn("Upstream response unreadable", "mirror", link, "query", query, "duration", time.Since(start), "error", err)
 			return "", err
 		}
+		slog.Debug("Upstream request", "mirror", link, "query", query, "status", resp.StatusCode, "duration", time.Since(start))
+		if resp.StatusCode == http.StatusOK {
+			countMirrorRequest(link, int64(len(bodyBytes)), "")
+		} else {
+			countMirrorRequest(link, int64(len(bodyBytes)), resp.Status)
+		}
 		if resp.Status == "200 OK" {
 			return string(bodyBytes), nil
 		}
+		lastStatus = resp.Status
+		if resp.StatusCode == http.StatusTooManyRequests {
+			wait := retryAfter(resp, 30*time.Second)
+			slog.Warn("Mirror is rate limiting us, backing off", "mirror", link, "retry_after", wait)
+			addWarning(mirrorLabel(link), "Mirror is rate limiting us, backing off for "+wait.String())
+			mirrorLimiter(link).backoff(time.Now().Add(wait))
+			continue
+		}
 		duration, _ := time.ParseDuration(strconv.Itoa((tries / len(ApiLink))) + "s")
 		time.Sleep(duration)
 	}
-	return "", errors.New("Request failed, servers probably overloaded")
+	return "", fmt.Errorf("Request for %s failed (last response: %s), servers probably overloaded", query, lastStatus)
 
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.senan.xyz/taglib"
+)
+
+// Every finished album folder gets a small manifest, so the history can be rebuilt after a restart with the
+// nzo_id Lidarr knows the job by. Older folders without one fall back to the tags of their tracks.
+
+const manifestName = ".tidlarr.json"
+
+// tag written to every track, the only way to get back to the album when the manifest is gone
+const tidalAlbumIdTag = "TIDAL_ALBUM_ID"
+
+type AlbumManifest struct {
+	Id        string    `json:"tidal_album_id"`
+	Artist    string    `json:"artist"`
+	Album     string    `json:"album"`
+	NumTracks int       `json:"num_tracks"`
+	Quality   string    `json:"quality"`
+	Completed time.Time `json:"completed"`
+	// output of the post-processing scripts
+	ScriptLog string `json:"script_log,omitempty"`
+	// how Lidarr's import went, if it didn't take the folder
+	ImportStatus  string `json:"import_status,omitempty"`
+	ImportMessage string `json:"import_message,omitempty"`
+}
+
+func writeManifest(download Download, folder string) error {
+	return saveManifest(AlbumManifest{
+		Id:        download.Id,
+		Artist:    download.Artist,
+		Album:     download.Album,
+		NumTracks: download.numTracks,
+		Quality:   outputQuality(),
+		Completed: time.Now(),
+	}, folder)
+}
+
+// updateManifest changes the manifest of an album folder that already has one
+func updateManifest(folder string, change func(manifest *AlbumManifest)) error {
+	manifest, err := readManifest(folder)
+	if err != nil {
+		return err
+	}
+	change(&manifest)
+	return saveManifest(manifest, folder)
+}
+
+func saveManifest(manifest AlbumManifest, folder string) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(folder, manifestName), data, 0644)
+}
+
+func readManifest(folder string) (AlbumManifest, error) {
+	var manifest AlbumManifest
+	data, err := os.ReadFile(filepath.Join(folder, manifestName))
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, err
+	}
+	if manifest.Id == "" {
+		return manifest, errors.New("manifest has no album ID")
+	}
+	return manifest, nil
+}
+
+func isAudioFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".flac", ".m4a", ".mp3", ".opus", ".ogg":
+		return true
+	}
+	return false
+}
+
+// manifestFromTags rebuilds what it can of the manifest from the tracks' tags
+func manifestFromTags(folder string) (AlbumManifest, error) {
+	var manifest AlbumManifest
+	var tracks []string
+	filepath.WalkDir(folder, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() && isAudioFile(entry.Name()) {
+			tracks = append(tracks, path)
+		}
+		return nil
+	})
+	if len(tracks) == 0 {
+		return manifest, errors.New("no tracks in " + folder)
+	}
+	tags, err := taglib.ReadTags(tracks[0])
+	if err != nil {
+		return manifest, err
+	}
+	first := func(key string) string {
+		if values := tags[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	manifest.Id = first(tidalAlbumIdTag)
+	manifest.Artist = first(taglib.AlbumArtist)
+	if manifest.Artist == "" {
+		manifest.Artist = first(taglib.Artist)
+	}
+	manifest.Album = first(taglib.Album)
+	manifest.NumTracks = len(tracks)
+	if manifest.Id == "" {
+		return manifest, errors.New("tracks aren't tagged with a Tidal album ID")
+	}
+	return manifest, nil
+}
+
+// folderSize adds up the size of every file below folder
+func folderSize(folder string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(folder, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
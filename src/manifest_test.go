@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.senan.xyz/taglib"
+)
+
+// restart forgets every download and rebuilds the history from disk, like a fresh start would
+func restart(t *testing.T) {
+	t.Helper()
+	DownloadsMutex.Lock()
+	Downloads = make(map[string]*Download)
+	DownloadsMutex.Unlock()
+	restoreHistory()
+}
+
+func TestHistoryRecoveredAfterRestart(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	item := findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Green Bar"}}), "Green Bar")
+	before := proxy.waitForHistory(t, proxy.grab(t, item))
+
+	tags, err := taglib.ReadTags(filepath.Join(before.Storage, "01 - The Testers - Setup.flac"))
+	if err != nil || tags[tidalAlbumIdTag][0] != "1001" {
+		t.Fatalf("track isn't tagged with the album ID: %v %v", tags, err)
+	}
+
+	restart(t)
+	slots := proxy.history(t, url.Values{}).History.Slots
+	if len(slots) != 1 {
+		t.Fatalf("expected one history entry, got %+v", slots)
+	}
+	after := slots[0]
+	if after.NzoId != "SABnzbd_nzo_1001" || after.Status != StatusCompleted || after.Name != before.Name {
+		t.Errorf("history wasn't recovered: %+v", after)
+	}
+	if after.Bytes != before.Bytes || after.Bytes < int64(2*len(proxy.Upstream.Flac)) {
+		t.Errorf("expected the real size %d, got %d", before.Bytes, after.Bytes)
+	}
+	download, _ := getDownload("1001")
+	if download.Artist != "The Testers" || download.Album != "Green Bar" || download.numTracks != 2 {
+		t.Errorf("metadata wasn't recovered: %+v", download)
+	}
+
+	//without the manifest, the tags still know the album
+	os.Remove(filepath.Join(before.Storage, manifestName))
+	restart(t)
+	if slots := proxy.history(t, url.Values{}).History.Slots; len(slots) != 1 || slots[0].NzoId != "SABnzbd_nzo_1001" {
+		t.Errorf("history wasn't recovered from tags: %+v", slots)
+	}
+}
+
+func TestHistoryOfUnknownFolder(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	os.MkdirAll(filepath.Join(DownloadPath, "complete", Category, "Someone-Something-TIDLARR"), 0755)
+	restart(t)
+	slots := proxy.history(t, url.Values{}).History.Slots
+	if len(slots) != 1 || slots[0].Name != "Someone-Something-TIDLARR" || len(slots[0].NzoId) != len("SABnzbd_nzo_")+13 {
+		t.Errorf("folders without any metadata should still show up: %+v", slots)
+	}
+}
+
+func TestHistoryKeepsNewerFolderOfSameAlbum(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	item := findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Green Bar"}}), "Green Bar")
+	slot := proxy.waitForHistory(t, proxy.grab(t, item))
+
+	// an older download of the same album under another name
+	older := filepath.Join(DownloadPath, "complete", Category, "The Testers-Green Bar-OLD-TIDLARR")
+	os.MkdirAll(older, 0755)
+	data, _ := json.Marshal(AlbumManifest{Id: "1001", Artist: "The Testers", Album: "Green Bar", NumTracks: 2, Completed: time.Now().Add(-time.Hour)})
+	os.WriteFile(filepath.Join(older, manifestName), data, 0644)
+
+	restart(t)
+	if slots := proxy.history(t, url.Values{}).History.Slots; len(slots) != 1 || slots[0].Name != slot.Name {
+		t.Errorf("expected the newer folder %s, got %+v", slot.Name, slots)
+	}
+
+	data, _ = json.Marshal(AlbumManifest{Id: "1001", Artist: "The Testers", Album: "Green Bar", NumTracks: 2, Completed: time.Now().Add(time.Hour)})
+	os.WriteFile(filepath.Join(older, manifestName), data, 0644)
+	restart(t)
+	if slots := proxy.history(t, url.Values{}).History.Slots; len(slots) != 1 || slots[0].Name != filepath.Base(older) {
+		t.Errorf("expected the newer folder %s, got %+v", filepath.Base(older), slots)
+	}
+}
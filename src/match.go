@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Comparing what Lidarr wants with what Tidal has. Names are compared after normalizing case, accents and
+// punctuation, as a ratio of the edit distance to their length. Search results are scored against the query, those
+// below SEARCH_MIN_SCORE (or by an artist below SEARCH_MIN_ARTIST_SCORE) are dropped and the rest listed best first.
+
+var SearchMinScore float64 = 0.6
+var SearchMinArtistScore float64 = 0.7
+
+// searchQuery is what Lidarr asked for, either free text or an artist and album
+type searchQuery struct {
+	Q      string
+	Artist string
+	Album  string
+}
+
+func setupSearchRanking() {
+	var err error
+	if SearchMinScore, err = strconv.ParseFloat(getEnv("SEARCH_MIN_SCORE", "0.6"), 64); err != nil || SearchMinScore < 0 || SearchMinScore > 1 {
+		exitWithError("Invalid SEARCH_MIN_SCORE", errors.New("needs to be between 0 and 1"))
+	}
+	if SearchMinArtistScore, err = strconv.ParseFloat(getEnv("SEARCH_MIN_ARTIST_SCORE", "0.7"), 64); err != nil || SearchMinArtistScore < 0 || SearchMinArtistScore > 1 {
+		exitWithError("Invalid SEARCH_MIN_ARTIST_SCORE", errors.New("needs to be between 0 and 1"))
+	}
+}
+
+// normalizeName lowercases, drops accents and punctuation and collapses spaces, so "Beyoncé – Lemonade!" and
+// "beyonce lemonade" compare equal. Accents are split off their letter (NFD) and dropped, & is spelled out
+func normalizeName(name string) string {
+	var b strings.Builder
+	space := false
+	word := func(w string) {
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteString(w)
+	}
+	for _, r := range norm.NFD.String(strings.ToLower(name)) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			//an accent split off its letter
+		case ligatures[r] != "":
+			word(ligatures[r])
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word(string(r))
+		case r == '&':
+			space = true
+			word("and")
+			space = true
+		default:
+			space = true
+		}
+	}
+	return b.String()
+}
+
+// ligatures spells out the latin letters that don't decompose into a plain letter and an accent
+var ligatures = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'ø': "o", 'ł': "l", 'đ': "d", 'ð': "d", 'þ': "th", 'ı': "i",
+}
+
+var featuring = regexp.MustCompile(`(?i)[(\[]?\s*\b(feat\.|feat|ft\.|featuring)\s.*$`)
+var bracketed = regexp.MustCompile(`\s*(\([^)]*\)|\[[^\]]*\])`)
+
+// baseName drops featured artists and bracketed editions, so "Lemonade (Deluxe) [feat. Jay-Z]" is "Lemonade"
+func baseName(name string) string {
+	base := strings.TrimSpace(bracketed.ReplaceAllString(featuring.ReplaceAllString(name, ""), ""))
+	if base == "" {
+		return name
+	}
+	return base
+}
+
+// similarity is 1 for names that normalize to the same, down to 0 for nothing in common
+func similarity(a string, b string) float64 {
+	x, y := []rune(normalizeName(a)), []rune(normalizeName(b))
+	if len(x) == 0 && len(y) == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(x, y))/float64(max(len(x), len(y)))
+}
+
+func levenshtein(a []rune, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// wantedAlbum is an album Lidarr is looking for
+type wantedAlbum struct {
+	Artist    string
+	Title     string
+	Year      string
+	NumTracks int
+}
+
+// matchScore rates how likely album is the one wanted, from 0 to 1. Artist and title count most, then the number
+// of tracks and the release year. Missing track counts or years count as half a match.
+func matchScore(wanted wantedAlbum, album Album) float64 {
+	score := 0.4*artistScore(wanted.Artist, album.Artist) + 0.4*titleScore(wanted.Title, album)
+	switch {
+	case wanted.NumTracks == 0 || album.NumTracks == 0:
+		score += 0.05
+	case int64(wanted.NumTracks) == album.NumTracks:
+		score += 0.1
+	case abs(int64(wanted.NumTracks)-album.NumTracks) <= 2:
+		score += 0.05
+	}
+	year := ""
+	if len(album.ReleaseDate) >= 4 {
+		year = album.ReleaseDate[:4]
+	}
+	switch {
+	case wanted.Year == "" || year == "":
+		score += 0.05
+	case wanted.Year == year:
+		score += 0.1
+	}
+	return score
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// artistScore compares artists without the ones featured
+func artistScore(wanted string, artist string) float64 {
+	return similarity(baseName(wanted), baseName(artist))
+}
+
+// titleScore compares titles mostly without editions, which only tip the balance to the edition asked for
+func titleScore(wanted string, album Album) float64 {
+	title := strings.TrimSpace(album.Title + " " + album.Edition)
+	return 0.8*similarity(baseName(wanted), baseName(album.Title)) + 0.2*similarity(wanted, title)
+}
+
+// searchScore rates how well album answers query, from 0 to 1. Free text is scored by how many of its words the
+// artist, title and edition have. The artist's score is returned as well.
+func searchScore(query searchQuery, album Album) (score float64, artist float64) {
+	artist = 1
+	if query.Artist != "" {
+		artist = artistScore(query.Artist, album.Artist)
+	}
+	switch {
+	case query.Artist != "" && query.Album != "":
+		return 0.5*artist + 0.5*titleScore(query.Album, album), artist
+	case query.Artist != "":
+		return artist, artist
+	case query.Album != "":
+		return titleScore(query.Album, album), artist
+	}
+	words := strings.Fields(normalizeName(query.Q))
+	if len(words) == 0 {
+		return 1, artist
+	}
+	found := strings.Fields(normalizeName(album.Artist + " " + album.Title + " " + album.Edition))
+	matched := 0.0
+	for _, word := range words {
+		best := 0.0
+		for _, candidate := range found {
+			best = max(best, similarity(word, candidate))
+		}
+		//a typo still counts, a different word doesn't
+		if best >= 0.8 {
+			matched += best
+		}
+	}
+	return matched / float64(len(words)), artist
+}
+
+// rankAlbums drops the albums that don't answer query well enough and sorts the rest best first. Upstream's order
+// settles ties.
+func rankAlbums(query searchQuery, albums []Album) []Album {
+	if query.Q == "" && query.Artist == "" && query.Album == "" {
+		return albums
+	}
+	scores := map[string]float64{}
+	var ranked []Album
+	for _, album := range albums {
+		score, artist := searchScore(query, album)
+		if score < SearchMinScore || artist < SearchMinArtistScore {
+			continue
+		}
+		scores[album.Id] = score
+		ranked = append(ranked, album)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return scores[ranked[i].Id] > scores[ranked[j].Id] })
+	return ranked
+}
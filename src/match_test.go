@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestBaseName(t *testing.T) {
+	for name, want := range map[string]string{
+		"Lemonade (Deluxe) [feat. Jay-Z]": "Lemonade",
+		"Run the World feat. Someone":     "Run the World",
+		"Daft Punk":                       "Daft Punk",
+		"(What's the Story)":              "(What's the Story)",
+		"Bookends [2001 Remaster]":        "Bookends",
+	} {
+		if got := baseName(name); got != want {
+			t.Errorf("baseName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	for name, want := range map[string]string{
+		"Dvořák – Œuvre Straße":    "dvorak oeuvre strasse",
+		"Sigur Rós: Ágætis byrjun": "sigur ros agaetis byrjun",
+		"Mötley Crüe":              "motley crue",
+		"& Juliet":                 "and juliet",
+		"Rock&Roll":                "rock and roll",
+	} {
+		if got := normalizeName(name); got != want {
+			t.Errorf("normalizeName(%q) = %q, want %q", name, got, want)
+		}
+	}
+	if score := similarity("& Juliet", "and Juliet"); score != 1 {
+		t.Errorf("a leading & should read as and, similarity is %v", score)
+	}
+}
+
+func TestRankAlbums(t *testing.T) {
+	albums := []Album{
+		{Id: "1", Artist: "Tribute Kids", Title: "Lemonade"},
+		{Id: "2", Artist: "Beyoncé", Title: "Lemonade", Edition: "Deluxe"},
+		{Id: "3", Artist: "Beyoncé", Title: "4"},
+		{Id: "4", Artist: "Beyonce feat. Jay-Z", Title: "Lemonade"},
+	}
+	ids := func(ranked []Album) (ids string) {
+		for _, album := range ranked {
+			ids += album.Id
+		}
+		return ids
+	}
+	if got := ids(rankAlbums(searchQuery{Artist: "Beyonce", Album: "Lemonade"}, albums)); got != "42" {
+		t.Errorf("expected the standard edition, then the deluxe one, got %s", got)
+	}
+	if got := ids(rankAlbums(searchQuery{Q: "beyonce lemonade deluxe"}, albums)); got != "24" {
+		t.Errorf("expected the deluxe edition first, got %s", got)
+	}
+	if got := ids(rankAlbums(searchQuery{}, albums)); got != "1234" {
+		t.Errorf("without a query nothing should change, got %s", got)
+	}
+}
+
+func TestSearchDropsUnrelatedAlbums(t *testing.T) {
+	track := []fakeTrack{{Id: 91, Title: "One", TrackNumber: 1, VolumeNumber: 1, Duration: 1}}
+	proxy := newTestProxy(t, "flac",
+		fakeAlbum{Id: "4001", Artist: "Bar Tenders", Title: "Green Bar Blues", ReleaseDate: "2020-01-01", Tracks: track},
+		fakeAlbum{Id: "4002", Artist: "The Testers", Title: "Green Bar", Version: "Deluxe", ReleaseDate: "2021-03-05", Tracks: track},
+		fakeAlbum{Id: "4003", Artist: "The Testers", Title: "Green Bar", ReleaseDate: "2021-03-05", Tracks: track},
+	)
+	rss := proxy.search(t, url.Values{"t": {"music"}, "artist": {"The Testers"}, "album": {"Green Bar"}})
+	if len(rss.Channel.Items) != 2 || rss.Channel.Items[0].Guid.Value != "http://www.tidal.com/album?id=4003" {
+		t.Errorf("expected the standard edition first and no other artists, got %+v", rss.Channel.Items)
+	}
+
+	rss = proxy.search(t, url.Values{"t": {"search"}, "q": {"Green Bar"}})
+	if len(rss.Channel.Items) != 3 {
+		t.Errorf("free text should keep every album with the words, got %d", len(rss.Channel.Items))
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A tiny Prometheus text exposition, so we don't need the client library for a handful of metrics.
+// Labels must only ever take a small, fixed set of values: no album names or IDs.
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var registry []metric
+
+type sample struct {
+	labels []string
+	value  float64
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+"=\""+escapeLabel(values[i])+"\"")
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"=\""+escapeLabel(extra[i+1])+"\"")
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounter(name string, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	registry = append(registry, c)
+	return c
+}
+
+func (c *counterVec) add(value float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(labelValues, "\xff")] += value
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) get(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[strings.Join(labelValues, "\xff")]
+}
+
+func (c *counterVec) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 && len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, strings.Split(key, "\xff")), formatValue(c.values[key]))
+	}
+}
+
+// gaugeFunc is computed when scraped
+type gaugeFunc struct {
+	name   string
+	help   string
+	labels []string
+	fn     func() []sample
+}
+
+func newGaugeFunc(name string, help string, labels []string, fn func() []sample) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, labels: labels, fn: fn}
+	registry = append(registry, g)
+	return g
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	for _, s := range g.fn() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, s.labels), formatValue(s.value))
+	}
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	counts  map[string][]uint64
+	sums    map[string]float64
+}
+
+func newHistogram(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, counts: map[string][]uint64{}, sums: map[string]float64{}}
+	registry = append(registry, h)
+	return h
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	counts, ok := h.counts[key]
+	if !ok {
+		// one extra slot for +Inf
+		counts = make([]uint64, len(h.buckets)+1)
+		h.counts[key] = counts
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			counts[i]++
+		}
+	}
+	counts[len(h.buckets)]++
+	h.sums[key] += value
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.counts))
+	for key := range h.counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		values := strings.Split(key, "\xff")
+		counts := h.counts[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", formatValue(bound)), counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", "+Inf"), counts[len(h.buckets)])
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values), formatValue(h.sums[key]))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), counts[len(h.buckets)])
+	}
+}
+
+// transferWindow remembers recent transfers to report the current download speed
+type transferWindow struct {
+	mu     sync.Mutex
+	window time.Duration
+	events []transferEvent
+}
+
+type transferEvent struct {
+	at    time.Time
+	bytes int64
+}
+
+func (t *transferWindow) record(bytes int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = append(t.events, transferEvent{at: time.Now(), bytes: bytes})
+	t.prune()
+}
+
+func (t *transferWindow) prune() {
+	cutoff := time.Now().Add(-t.window)
+	i := 0
+	for i < len(t.events) && t.events[i].at.Before(cutoff) {
+		i++
+	}
+	t.events = t.events[i:]
+}
+
+// speed returns bytes per second over the window
+func (t *transferWindow) speed() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune()
+	var total int64
+	for _, event := range t.events {
+		total += event.bytes
+	}
+	return float64(total) / t.window.Seconds()
+}
+
+var recentTransfers = &transferWindow{window: 30 * time.Second}
+
+var durationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+var searchesTotal = newCounter("tidlarr_searches_total", "Searches answered by the indexer, by outcome.", "handler", "status")
+var searchDuration = newHistogram("tidlarr_search_duration_seconds", "Time taken to answer a search.", durationBuckets, "handler", "status")
+var upstreamRequestsTotal = newCounter("tidlarr_upstream_requests_total", "Requests sent to upstream mirrors, by response status.", "mirror", "status")
+var upstreamDuration = newHistogram("tidlarr_upstream_request_duration_seconds", "Upstream request latency.", durationBuckets, "mirror")
+var albumsQueuedTotal = newCounter("tidlarr_albums_queued_total", "Albums grabbed by Lidarr.")
+var albumsCompletedTotal = newCounter("tidlarr_albums_completed_total", "Albums downloaded successfully.")
+var albumsFailedTotal = newCounter("tidlarr_albums_failed_total", "Albums that failed to download.")
+var tracksDownloadedTotal = newCounter("tidlarr_tracks_downloaded_total", "Tracks downloaded.")
+var tracksFailedVerificationTotal = newCounter("tidlarr_tracks_failed_verification_total", "Downloaded tracks that failed verification and were downloaded again.")
+var bytesDownloadedTotal = newCounter("tidlarr_downloaded_bytes_total", "Bytes of audio and artwork downloaded.")
+
+var _ = newGaugeFunc("tidlarr_albums", "Albums currently in the queue, by status.", []string{"status"}, func() []sample {
+	counts := map[string]float64{StatusQueued: 0, StatusFetching: 0, StatusDownloading: 0, StatusPaused: 0, StatusRunning: 0}
+	for _, download := range listDownloads() {
+		if _, ok := counts[download.Status]; ok {
+			counts[download.Status]++
+		}
+	}
+	return []sample{
+		{labels: []string{"queued"}, value: counts[StatusQueued]},
+		{labels: []string{"fetching"}, value: counts[StatusFetching]},
+		{labels: []string{"downloading"}, value: counts[StatusDownloading]},
+		{labels: []string{"paused"}, value: counts[StatusPaused]},
+		{labels: []string{"running"}, value: counts[StatusRunning]},
+	}
+})
+
+var _ = newGaugeFunc("tidlarr_download_speed_bytes", "Download speed averaged over the last 30 seconds, in bytes per second.", nil, func() []sample {
+	return []sample{{value: recentTransfers.speed()}}
+})
+
+// recordTransfer accounts for a finished file transfer
+func recordTransfer(bytes int64) {
+	bytesDownloadedTotal.add(float64(bytes))
+	recentTransfers.record(bytes)
+	countDownload(bytes)
+}
+
+// mirrorLabel keeps the label to the mirror's host, the only part that identifies it
+func mirrorLabel(link string) string {
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		return "unknown"
+	}
+	return u.Host
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range registry {
+		m.write(w)
+	}
+}
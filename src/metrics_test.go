@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsAfterGrab(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	tracksBefore := tracksDownloadedTotal.get()
+	completedBefore := albumsCompletedTotal.get()
+
+	item := findItem(t, proxy.search(t, url.Values{"t": {"music"}, "artist": {"The Testers"}, "album": {"Green Bar"}}), "Green Bar")
+	proxy.waitForHistory(t, proxy.grab(t, item))
+
+	if got := tracksDownloadedTotal.get() - tracksBefore; got != 2 {
+		t.Errorf("expected 2 more tracks downloaded, got %v", got)
+	}
+	if got := albumsCompletedTotal.get() - completedBefore; got != 1 {
+		t.Errorf("expected 1 more album completed, got %v", got)
+	}
+
+	body := proxy.get(t, "/metrics", url.Values{})
+	mirror := mirrorLabel(proxy.Upstream.URL)
+	for _, expected := range []string{
+		`tidlarr_searches_total{handler="music",status="ok"}`,
+		`tidlarr_search_duration_seconds_bucket{handler="music",status="ok",le="+Inf"}`,
+		`tidlarr_upstream_requests_total{mirror="` + mirror + `",status="200"}`,
+		`tidlarr_albums{status="downloading"} 0`,
+		"# TYPE tidlarr_downloaded_bytes_total counter",
+		"tidlarr_download_speed_bytes ",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("metrics are missing %q", expected)
+		}
+	}
+	if strings.Contains(body, "1001") || strings.Contains(body, "Green Bar") {
+		t.Error("metrics shouldn't carry per-album labels")
+	}
+}
+
+func TestFailedSearchIsCounted(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	ApiLink = []string{"http://127.0.0.1:1"}
+	errorsBefore, okBefore := searchesTotal.get("search", "error"), searchesTotal.get("search", "ok")
+	if status, _ := proxy.getStatus(t, "/indexer", url.Values{"t": {"search"}, "q": {"Red Bar"}}); status != http.StatusServiceUnavailable {
+		t.Fatalf("expected the search to fail, got %d", status)
+	}
+	if searchesTotal.get("search", "error")-errorsBefore != 1 || searchesTotal.get("search", "ok") != okBefore {
+		t.Error("failed search wasn't counted as an error")
+	}
+	if body := proxy.get(t, "/metrics", url.Values{}); !strings.Contains(body, `tidlarr_search_duration_seconds_count{handler="search",status="error"}`) {
+		t.Error("failed search's duration wasn't recorded")
+	}
+}
+
+func TestTransferWindowSpeed(t *testing.T) {
+	window := &transferWindow{window: 10 * time.Second}
+	window.record(1000)
+	window.record(4000)
+	if speed := window.speed(); speed != 500 {
+		t.Errorf("expected 500 B/s, got %v", speed)
+	}
+}
+
+func TestQueueGaugeCountsRunningScripts(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	DownloadsMutex.Lock()
+	Downloads["1001"] = &Download{Id: "1001", FileName: "Running-TIDLARR", Status: StatusRunning, numTracks: 1, downloaded: 1}
+	DownloadsMutex.Unlock()
+	if body := proxy.get(t, "/metrics", url.Values{}); !strings.Contains(body, `tidlarr_albums{status="running"} 1`) {
+		t.Errorf("jobs running scripts are missing from the queue gauge:\n%s", body)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// incomplete/ and complete/ are often separate Docker volumes, where a rename fails with EXDEV. Finished albums are
+// then copied next to their destination, synced, and renamed into place, so complete/ never holds half an album.
+
+// rename is os.Rename, swapped in tests to imitate separate filesystems
+var rename = os.Rename
+
+// suffixes of the temporary folders a move leaves behind if it's interrupted
+const partialSuffix = ".tidlarr-partial"
+const replacedSuffix = ".tidlarr-replaced"
+
+// moveFolder moves a finished album folder to target. A folder already at target, from an earlier grab of the same
+// release, is replaced once the new one is in place.
+func moveFolder(source string, target string) error {
+	if _, err := os.Lstat(target); err == nil {
+		replaced := target + replacedSuffix
+		if err := os.RemoveAll(replaced); err != nil {
+			return err
+		}
+		if err := rename(target, replaced); err != nil {
+			return fmt.Errorf("couldn't move the existing %s aside: %w", filepath.Base(target), err)
+		}
+		if err := moveFolder(source, target); err != nil {
+			if restoreErr := rename(replaced, target); restoreErr != nil {
+				slog.Error("Couldn't restore the replaced folder", "folder", replaced, "error", restoreErr)
+			}
+			return err
+		}
+		slog.Info("Replaced an earlier download of the same release", "folder", filepath.Base(target))
+		return os.RemoveAll(replaced)
+	}
+
+	err := rename(source, target)
+	if err == nil {
+		return nil
+	}
+	slog.Debug("Couldn't rename, copying instead", "source", source, "target", target, "error", err)
+	partial := target + partialSuffix
+	if err := os.RemoveAll(partial); err != nil {
+		return err
+	}
+	if err := copyTree(source, partial); err != nil {
+		os.RemoveAll(partial)
+		return fmt.Errorf("couldn't copy %s to %s: %w", filepath.Base(source), filepath.Dir(target), err)
+	}
+	if err := rename(partial, target); err != nil {
+		os.RemoveAll(partial)
+		return fmt.Errorf("couldn't move %s into place: %w", filepath.Base(target), err)
+	}
+	syncDir(filepath.Dir(target))
+	return os.RemoveAll(source)
+}
+
+// moveFile moves a single file, copying and syncing it when rename isn't possible
+func moveFile(source string, target string) error {
+	if err := rename(source, target); err == nil {
+		return nil
+	}
+	if err := copyFile(source, target); err != nil {
+		os.Remove(target)
+		return err
+	}
+	return os.Remove(source)
+}
+
+// copyTree copies a folder, syncing every file and folder before returning
+func copyTree(source string, target string) error {
+	var dirs []string
+	err := filepath.WalkDir(source, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		destination := filepath.Join(target, relative)
+		if entry.IsDir() {
+			dirs = append(dirs, destination)
+			return os.MkdirAll(destination, 0755)
+		}
+		return copyFile(path, destination)
+	})
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		syncDir(dir)
+	}
+	return nil
+}
+
+func copyFile(source string, target string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// syncDir makes the entries of a folder durable. Not every platform can sync a folder, so failures are ignored.
+func syncDir(dir string) {
+	if f, err := os.Open(dir); err == nil {
+		f.Sync()
+		f.Close()
+	}
+}
+
+// cleanInterruptedMoves removes what a move interrupted by a crash left in complete/. A replaced folder whose
+// replacement never arrived is put back.
+func cleanInterruptedMoves() {
+	dir := filepath.Join(DownloadPath, "complete", Category)
+	folders, _ := os.ReadDir(dir)
+	for _, folder := range folders {
+		path := filepath.Join(dir, folder.Name())
+		switch {
+		case strings.HasSuffix(folder.Name(), partialSuffix):
+			slog.Info("Removing interrupted move", "folder", folder.Name())
+			os.RemoveAll(path)
+		case strings.HasSuffix(folder.Name(), replacedSuffix):
+			original := strings.TrimSuffix(path, replacedSuffix)
+			if _, err := os.Lstat(original); err == nil {
+				os.RemoveAll(path)
+			} else if err := rename(path, original); err != nil {
+				slog.Error("Couldn't restore replaced folder", "folder", folder.Name(), "error", err)
+			}
+		}
+	}
+}
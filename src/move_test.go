@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// separateFilesystems makes renames out of incomplete/ fail like they do across Docker volumes
+func separateFilesystems(t *testing.T) {
+	t.Helper()
+	t.Cleanup(func() { rename = os.Rename })
+	rename = func(source string, target string) error {
+		if strings.Contains(source, "incomplete") != strings.Contains(target, "incomplete") {
+			return &os.LinkError{Op: "rename", Old: source, New: target, Err: syscall.EXDEV}
+		}
+		return os.Rename(source, target)
+	}
+}
+
+func TestMoveFolderAcrossFilesystems(t *testing.T) {
+	separateFilesystems(t)
+	root := t.TempDir()
+	source := filepath.Join(root, "incomplete", "album")
+	target := filepath.Join(root, "complete", "album")
+	os.MkdirAll(filepath.Join(source, "CD2"), 0755)
+	os.MkdirAll(filepath.Dir(target), 0755)
+	os.WriteFile(filepath.Join(source, "01.flac"), []byte("one"), 0644)
+	os.WriteFile(filepath.Join(source, "CD2", "01.flac"), []byte("two"), 0644)
+
+	if err := moveFolder(source, target); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(target, "CD2", "01.flac")); err != nil || string(data) != "two" {
+		t.Errorf("nested file wasn't copied: %q %v", data, err)
+	}
+	if _, err := os.Stat(source); !os.IsNotExist(err) {
+		t.Errorf("source should be gone after the copy: %v", err)
+	}
+	if _, err := os.Stat(target + partialSuffix); !os.IsNotExist(err) {
+		t.Errorf("partial copy left behind: %v", err)
+	}
+}
+
+func TestMoveFolderReplacesEarlierGrab(t *testing.T) {
+	root := t.TempDir()
+	source := filepath.Join(root, "incomplete", "album")
+	target := filepath.Join(root, "complete", "album")
+	os.MkdirAll(source, 0755)
+	os.MkdirAll(target, 0755)
+	os.WriteFile(filepath.Join(source, "new.flac"), []byte("new"), 0644)
+	os.WriteFile(filepath.Join(target, "old.flac"), []byte("old"), 0644)
+
+	if err := moveFolder(source, target); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(target, "new.flac")); err != nil {
+		t.Errorf("new download missing: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(target, "old.flac")); !os.IsNotExist(err) {
+		t.Errorf("earlier download should be replaced: %v", err)
+	}
+	if _, err := os.Stat(target + replacedSuffix); !os.IsNotExist(err) {
+		t.Errorf("replaced folder left behind: %v", err)
+	}
+}
+
+func TestFailedMoveKeepsEarlierGrab(t *testing.T) {
+	t.Cleanup(func() { rename = os.Rename })
+	rename = func(source string, target string) error {
+		if strings.Contains(source, "incomplete") {
+			return &os.LinkError{Op: "rename", Old: source, New: target, Err: syscall.EXDEV}
+		}
+		return os.Rename(source, target)
+	}
+	root := t.TempDir()
+	target := filepath.Join(root, "complete", "album")
+	os.MkdirAll(target, 0755)
+	os.WriteFile(filepath.Join(target, "old.flac"), []byte("old"), 0644)
+
+	if err := moveFolder(filepath.Join(root, "incomplete", "missing"), target); err == nil {
+		t.Fatal("moving a missing folder should fail")
+	}
+	if _, err := os.Stat(filepath.Join(target, "old.flac")); err != nil {
+		t.Errorf("earlier download should be restored after a failed move: %v", err)
+	}
+}
+
+func TestGrabCompletesAcrossFilesystems(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	separateFilesystems(t)
+	item := findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Red Bar"}}), "Red Bar")
+	slot := proxy.waitForHistory(t, proxy.grab(t, item))
+	if slot.Status != "Completed" {
+		t.Fatalf("download failed: %+v", slot)
+	}
+	if _, err := os.Stat(filepath.Join(slot.Storage, "01 - The Testers - Flaky.flac")); err != nil {
+		t.Errorf("track missing from complete: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(DownloadPath, "incomplete", Category, item.Title)); !os.IsNotExist(err) {
+		t.Errorf("album left in incomplete: %v", err)
+	}
+}
+
+func TestGrabFailsWhenMoveFails(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	t.Cleanup(func() { rename = os.Rename })
+	rename = func(source string, target string) error {
+		return &os.LinkError{Op: "rename", Old: source, New: target, Err: syscall.EACCES}
+	}
+	item := findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Red Bar"}}), "Red Bar")
+	slot := proxy.waitForHistory(t, proxy.grab(t, item))
+	if slot.Status != "Failed" || !strings.Contains(slot.FailMessage, "complete folder") {
+		t.Errorf("a failed move should fail the job, got %+v", slot)
+	}
+}
+
+func TestInterruptedMovesAreCleanedUp(t *testing.T) {
+	newTestProxy(t, "flac")
+	complete := filepath.Join(DownloadPath, "complete", Category)
+	os.MkdirAll(filepath.Join(complete, "A-TIDLARR"+partialSuffix), 0755)
+	os.MkdirAll(filepath.Join(complete, "B-TIDLARR"+replacedSuffix), 0755)
+	cleanInterruptedMoves()
+	if _, err := os.Stat(filepath.Join(complete, "A-TIDLARR"+partialSuffix)); !os.IsNotExist(err) {
+		t.Errorf("partial copy should be removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(complete, "B-TIDLARR")); err != nil {
+		t.Errorf("replaced folder without replacement should be restored: %v", err)
+	}
+}
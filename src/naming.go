@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Track files are named from TRACK_TEMPLATE when the album is fetched. Multi-disc albums either get a CD<n> folder per
+// disc or, if the template doesn't tell discs apart, a "<disc>-" prefix. Names still colliding after that get a
+// " (2)", " (3)"... suffix in album order, so a resumed download comes up with the same names.
+
+var TrackTemplate string = "{track} - {artist} - {title}"
+var DiscFolders bool
+var DiscFolderTemplate string = "CD{disc}"
+
+var templateField = regexp.MustCompile(`\{([a-z]+)\}`)
+var templateFields = []string{"disc", "discs", "track", "tracks", "artist", "title", "album", "year", "isrc"}
+
+func setupNaming() {
+	TrackTemplate = getEnv("TRACK_TEMPLATE", TrackTemplate)
+	DiscFolderTemplate = getEnv("DISC_FOLDER_TEMPLATE", DiscFolderTemplate)
+	DiscFolders = getEnv("DISC_FOLDERS", "false") == "true"
+	for _, template := range []string{TrackTemplate, DiscFolderTemplate} {
+		if err := checkTemplate(template); err != nil {
+			exitWithError("Invalid naming template", err)
+		}
+	}
+}
+
+func checkTemplate(template string) error {
+	for _, match := range templateField.FindAllStringSubmatch(template, -1) {
+		known := false
+		for _, field := range templateFields {
+			known = known || match[1] == field
+		}
+		if !known {
+			return fmt.Errorf("unknown field {%s} in %q, use one of {%s}", match[1], template, strings.Join(templateFields, "}, {"))
+		}
+	}
+	if !templateField.MatchString(template) {
+		return fmt.Errorf("%q doesn't use any field", template)
+	}
+	return nil
+}
+
+// renderTemplate fills in a template. Field values can't add folders, but the template itself can with "/".
+func renderTemplate(template string, fields map[string]string) string {
+	var parts []string
+	for _, part := range strings.Split(template, "/") {
+		part = templateField.ReplaceAllStringFunc(part, func(field string) string {
+			return sanitizeFilename(fields[strings.Trim(field, "{}")])
+		})
+		part = strings.TrimSpace(part)
+		if part != "" && part != "." && part != ".." {
+			parts = append(parts, part)
+		}
+	}
+	return filepath.Join(parts...)
+}
+
+// pad zero-pads a number to the width of the largest one it's counted against, at least two digits
+func pad(number string, largest int) string {
+	width := max(2, len(strconv.Itoa(largest)))
+	if len(number) >= width {
+		return number
+	}
+	return strings.Repeat("0", width-len(number)) + number
+}
+
+// assignTrackPaths names every track of an album, relative to the album folder and without extension
+func assignTrackPaths(download *Download) {
+	tracksOnDisc := map[string]int{}
+	for _, track := range download.Files {
+		number, _ := strconv.Atoi(track.Index)
+		tracksOnDisc[track.mediaNumber] = max(tracksOnDisc[track.mediaNumber], number)
+	}
+	template := TrackTemplate
+	multiDisc := download.mediaCount > 1
+	if multiDisc && DiscFolders {
+		template = DiscFolderTemplate + "/" + template
+	} else if multiDisc && !strings.Contains(template, "{disc}") {
+		template = "{disc}-" + template
+	}
+
+	taken := map[string]bool{}
+	for i := range download.Files {
+		track := &download.Files[i]
+		path := renderTemplate(template, map[string]string{
+			"disc":   track.mediaNumber,
+			"discs":  strconv.Itoa(download.mediaCount),
+			"track":  pad(track.Index, tracksOnDisc[track.mediaNumber]),
+			"tracks": strconv.Itoa(tracksOnDisc[track.mediaNumber]),
+			"artist": download.Artist,
+			"title":  track.Name,
+			"album":  download.Album,
+			"year":   download.year,
+			"isrc":   track.isrc,
+		})
+		//compared case-insensitively, Windows and macOS would overwrite those too
+		unique := path
+		for n := 2; taken[strings.ToLower(unique)]; n++ {
+			unique = path + " (" + strconv.Itoa(n) + ")"
+		}
+		taken[strings.ToLower(unique)] = true
+		track.path = unique
+	}
+}
+
+// trackFileName names a track's file relative to the album folder, without its extension
+func trackFileName(download Download, track File) string {
+	if track.path == "" {
+		return sanitizeFilename(track.Index + " - " + download.Artist + " - " + track.Name)
+	}
+	return track.path
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func useNaming(t *testing.T, template string, discFolders bool) {
+	t.Helper()
+	oldTemplate, oldFolders := TrackTemplate, DiscFolders
+	t.Cleanup(func() {
+		TrackTemplate, DiscFolders = oldTemplate, oldFolders
+	})
+	TrackTemplate, DiscFolders = template, discFolders
+}
+
+func namingAlbum(mediaCount int, tracks ...File) *Download {
+	return &Download{Artist: "AC/DC", Album: "Live", year: "1992", mediaCount: mediaCount, Files: tracks}
+}
+
+func trackPaths(download *Download) []string {
+	assignTrackPaths(download)
+	var paths []string
+	for _, track := range download.Files {
+		paths = append(paths, filepath.ToSlash(track.path))
+	}
+	return paths
+}
+
+func TestTrackNames(t *testing.T) {
+	useNaming(t, "{track} - {artist} - {title}", false)
+	paths := trackPaths(namingAlbum(1,
+		File{Index: "1", mediaNumber: "1", Name: "Thunderstruck"},
+		File{Index: "2", mediaNumber: "1", Name: "Who? Me?"},
+	))
+	if strings.Join(paths, "|") != "01 - AC_DC - Thunderstruck|02 - AC_DC - Who_ Me_" {
+		t.Errorf("unexpected names %v", paths)
+	}
+}
+
+func TestTrackNumbersPadToLongestDisc(t *testing.T) {
+	useNaming(t, "{track}", false)
+	album := namingAlbum(1)
+	for i := 1; i <= 120; i++ {
+		album.Files = append(album.Files, File{Index: strconv.Itoa(i), mediaNumber: "1", Name: "x"})
+	}
+	paths := trackPaths(album)
+	if paths[0] != "001" || paths[119] != "120" {
+		t.Errorf("unexpected padding %s, %s", paths[0], paths[119])
+	}
+}
+
+func TestMultiDiscNamesDontCollide(t *testing.T) {
+	tracks := []File{
+		{Index: "1", mediaNumber: "1", Name: "Intro"},
+		{Index: "1", mediaNumber: "2", Name: "Intro"},
+	}
+
+	useNaming(t, "{track} - {title}", false)
+	if paths := trackPaths(namingAlbum(2, tracks...)); strings.Join(paths, "|") != "1-01 - Intro|2-01 - Intro" {
+		t.Errorf("discs should be told apart by a prefix, got %v", paths)
+	}
+
+	useNaming(t, "{track} - {title}", true)
+	if paths := trackPaths(namingAlbum(2, tracks...)); strings.Join(paths, "|") != "CD1/01 - Intro|CD2/01 - Intro" {
+		t.Errorf("discs should get their own folder, got %v", paths)
+	}
+
+	useNaming(t, "{disc}{track} {album} ({year})", false)
+	if paths := trackPaths(namingAlbum(2, tracks...)); strings.Join(paths, "|") != "101 Live (1992)|201 Live (1992)" {
+		t.Errorf("a template with {disc} shouldn't get a prefix, got %v", paths)
+	}
+}
+
+func TestTrackNameCollisionsAreNumbered(t *testing.T) {
+	useNaming(t, "{title}", false)
+	album := namingAlbum(1,
+		File{Index: "1", mediaNumber: "1", Name: "Untitled"},
+		File{Index: "2", mediaNumber: "1", Name: "untitled"},
+		File{Index: "3", mediaNumber: "1", Name: "Untitled"},
+	)
+	first := trackPaths(album)
+	if strings.Join(first, "|") != "Untitled|untitled (2)|Untitled (3)" {
+		t.Errorf("unexpected names %v", first)
+	}
+	if again := trackPaths(album); strings.Join(again, "|") != strings.Join(first, "|") {
+		t.Errorf("names should be the same every time, got %v then %v", first, again)
+	}
+}
+
+func TestTemplateFieldsAreChecked(t *testing.T) {
+	if err := checkTemplate("{track} - {composer}"); err == nil || !strings.Contains(err.Error(), "{composer}") {
+		t.Errorf("unknown field should be rejected, got %v", err)
+	}
+	if err := checkTemplate("track"); err == nil {
+		t.Error("template without fields should be rejected")
+	}
+	if err := checkTemplate("{artist}/{album}/{track} {title}"); err != nil {
+		t.Errorf("valid template rejected: %v", err)
+	}
+}
+
+func TestGrabMultiDiscAlbumIntoDiscFolders(t *testing.T) {
+	useNaming(t, "{track} - {title}", true)
+	album := fakeAlbum{
+		Id: "1003", Artist: "The Testers", Title: "Double Bar", ReleaseDate: "2020-01-01", Cover: "aaaa-bbbb-cccc",
+		Tracks: []fakeTrack{
+			{Id: 31, Title: "Intro", TrackNumber: 1, VolumeNumber: 1, Duration: 1},
+			{Id: 32, Title: "Intro", TrackNumber: 1, VolumeNumber: 2, Duration: 1},
+		},
+	}
+	proxy := newTestProxy(t, "flac", album)
+	slot := proxy.waitForHistory(t, proxy.grab(t, findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Double"}}), "Double Bar")))
+	if slot.Status != "Completed" {
+		t.Fatalf("download failed: %+v", slot)
+	}
+	for _, path := range []string{"CD1/01 - Intro.flac", "CD2/01 - Intro.flac"} {
+		if _, err := os.Stat(filepath.Join(slot.Storage, path)); err != nil {
+			t.Errorf("track missing: %v", err)
+		}
+	}
+}
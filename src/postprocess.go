@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// After a job completes or fails, each script in SCRIPTS runs with the same arguments and SAB_* variables SABnzbd
+// gives its post-processing scripts, so existing ones keep working. A script exiting with anything but 0 fails the
+// job, with its last line of output as the reason, like in SABnzbd. At most SCRIPT_CONCURRENCY scripts run at once.
+
+var Scripts []string
+var ScriptTimeout time.Duration
+var scriptSlots chan struct{}
+
+// output kept per job, the rest is cut
+const maxScriptLog = 64 << 10
+
+func setupScripts() {
+	for _, script := range strings.Split(getEnv("SCRIPTS", ""), ",") {
+		if script = strings.TrimSpace(script); script != "" {
+			Scripts = append(Scripts, script)
+		}
+	}
+	var err error
+	ScriptTimeout, err = time.ParseDuration(getEnv("SCRIPT_TIMEOUT", "10m"))
+	if err != nil {
+		exitWithError("Invalid SCRIPT_TIMEOUT", err)
+	}
+	concurrency, err := strconv.Atoi(getEnv("SCRIPT_CONCURRENCY", "1"))
+	if err != nil || concurrency < 1 {
+		exitWithError("Invalid SCRIPT_CONCURRENCY", errors.New("needs to be 1 or more"))
+	}
+	scriptSlots = make(chan struct{}, concurrency)
+	for _, script := range Scripts {
+		if _, err := os.Stat(script); err != nil {
+			exitWithError("Post-processing script not found", err)
+		}
+	}
+	if len(Scripts) > 0 {
+		slog.Info("Post-processing scripts enabled", "scripts", Scripts, "timeout", ScriptTimeout, "concurrency", concurrency)
+	}
+}
+
+// scriptName is what get_config reports as the category's script
+func scriptName() string {
+	if len(Scripts) == 0 {
+		return "None"
+	}
+	return filepath.Base(Scripts[0])
+}
+
+// scriptEnv builds SABnzbd's positional arguments and environment for a finished job
+func scriptEnv(download Download, folder string, failed bool) ([]string, []string) {
+	status, ppStatus := StatusCompleted, "0"
+	if failed {
+		status, ppStatus = StatusFailed, "-1"
+	}
+	size, _ := folderSize(folder)
+	args := []string{folder, download.FileName + ".nzb", download.FileName, "", Category, "", ppStatus, ""}
+	env := append(os.Environ(),
+		"SAB_COMPLETE_DIR="+folder,
+		"SAB_FINAL_NAME="+download.FileName,
+		"SAB_FILENAME="+download.FileName+".nzb",
+		"SAB_CAT="+Category,
+		"SAB_PP_STATUS="+ppStatus,
+		"SAB_STATUS="+status,
+		"SAB_FAIL_MSG="+download.FailMessage,
+		"SAB_NZO_ID=SABnzbd_nzo_"+download.Id,
+		"SAB_BYTES="+strconv.FormatInt(size, 10),
+		"SAB_VERSION="+sabVersion,
+		"SAB_PP=3",
+		"SAB_PRIORITY=0",
+		"TIDAL_ALBUM_ID="+download.Id,
+	)
+	return args, env
+}
+
+// runScripts runs every script for a finished job in order. Returns their combined output, and an error with the
+// failing script's last line if one of them didn't exit with 0.
+func runScripts(download Download, folder string, failed bool) (string, error) {
+	if len(Scripts) == 0 {
+		return "", nil
+	}
+	scriptSlots <- struct{}{}
+	defer func() { <-scriptSlots }()
+
+	args, env := scriptEnv(download, folder, failed)
+	var log strings.Builder
+	var scriptErr error
+	for _, script := range Scripts {
+		start := time.Now()
+		output, err := runScript(script, args, env)
+		log.Write(output)
+		slog.Info("Post-processing script finished", "nzo_id", "SABnzbd_nzo_"+download.Id, "script", filepath.Base(script), "duration", time.Since(start), "error", err)
+		if err != nil && scriptErr == nil {
+			reason := err.Error()
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) && lastLine(string(output)) != "" {
+				reason = lastLine(string(output))
+			}
+			scriptErr = fmt.Errorf("%s: %s", filepath.Base(script), reason)
+		}
+	}
+	scriptLog := log.String()
+	if len(scriptLog) > maxScriptLog {
+		scriptLog = scriptLog[len(scriptLog)-maxScriptLog:]
+	}
+	return scriptLog, scriptErr
+}
+
+func runScript(script string, args []string, env []string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ScriptTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, script, args...)
+	cmd.Env = env
+	cmd.Dir = filepath.Dir(script)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	//don't wait for children that hold on to the output after the script was killed
+	cmd.WaitDelay = 5 * time.Second
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return output.Bytes(), fmt.Errorf("timed out after %s", ScriptTimeout)
+	}
+	return output.Bytes(), err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useScripts installs shell scripts with the given bodies as the post-processing scripts
+func useScripts(t *testing.T, timeout time.Duration, bodies ...string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("test scripts are shell scripts")
+	}
+	oldScripts, oldTimeout, oldSlots := Scripts, ScriptTimeout, scriptSlots
+	t.Cleanup(func() { Scripts, ScriptTimeout, scriptSlots = oldScripts, oldTimeout, oldSlots })
+	dir := t.TempDir()
+	Scripts = nil
+	for i, body := range bodies {
+		path := filepath.Join(dir, "script"+string(rune('a'+i))+".sh")
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755); err != nil {
+			t.Fatal(err)
+		}
+		Scripts = append(Scripts, path)
+	}
+	ScriptTimeout = timeout
+	scriptSlots = make(chan struct{}, 1)
+	return dir
+}
+
+func TestScriptGetsSabnzbdArguments(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	dir := useScripts(t, time.Minute,
+		"echo \"args $1|$2|$3|$5|$7\"\n"+
+			"echo \"env $SAB_STATUS|$SAB_PP_STATUS|$SAB_NZO_ID|$TIDAL_ALBUM_ID|$SAB_CAT\"\n"+
+			"ls \"$SAB_COMPLETE_DIR\" > files.txt\n"+
+			"echo all done\n",
+		"echo second script\n")
+
+	item := findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Red Bar"}}), "Red Bar")
+	nzoId := proxy.grab(t, item)
+	slot := proxy.waitForHistory(t, nzoId)
+	if slot.Status != "Completed" {
+		t.Fatalf("download failed: %+v", slot)
+	}
+	folder := filepath.Join(DownloadPath, "complete", Category, item.Title)
+	for _, expected := range []string{
+		"args " + folder + "|" + item.Title + ".nzb|" + item.Title + "|music|0",
+		"env Completed|0|" + nzoId + "|1002|music",
+		"all done",
+		"second script",
+	} {
+		if !strings.Contains(slot.ScriptLog, expected) {
+			t.Errorf("script log is missing %q:\n%s", expected, slot.ScriptLog)
+		}
+	}
+	if slot.ScriptLine != "second script" || slot.Script != "scripta.sh" {
+		t.Errorf("unexpected script line %q and name %q", slot.ScriptLine, slot.Script)
+	}
+	// the scripts run from their own folder, after the album is in place
+	if files, err := os.ReadFile(filepath.Join(dir, "files.txt")); err != nil || !strings.Contains(string(files), "Flaky.flac") {
+		t.Errorf("script should see the completed album: %q %v", files, err)
+	}
+
+	// the output survives rebuilding the history
+	restart(t)
+	if slots := proxy.history(t, url.Values{}).History.Slots; len(slots) != 1 || slots[0].ScriptLog != slot.ScriptLog {
+		t.Errorf("script log lost after a restart: %+v", slots)
+	}
+}
+
+func TestFailingScriptFailsJob(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	useScripts(t, time.Minute, "echo checking\necho library is read-only\nexit 1\n")
+	slot := proxy.waitForHistory(t, proxy.grab(t, findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Red Bar"}}), "Red Bar")))
+	if slot.Status != "Failed" || slot.FailMessage != "scripta.sh: library is read-only" {
+		t.Errorf("a failing script should fail the job with its last line, got %+v", slot)
+	}
+}
+
+func TestScriptRunsForFailedJob(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	proxy.Upstream.Corrupt(100)
+	useScripts(t, time.Minute, "echo \"$SAB_STATUS $7 $SAB_FAIL_MSG\"\n")
+	slot := proxy.waitForHistory(t, proxy.grab(t, findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Red Bar"}}), "Red Bar")))
+	if slot.Status != "Failed" || !strings.HasPrefix(slot.ScriptLine, "Failed -1 track Flaky failed verification") {
+		t.Errorf("script should hear about the failure, got %+v", slot)
+	}
+	if !strings.Contains(slot.FailMessage, "failed verification") {
+		t.Errorf("the download's own failure should be kept, got %q", slot.FailMessage)
+	}
+}
+
+func TestScriptTimeout(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	useScripts(t, 200*time.Millisecond, "echo started\nexec sleep 10\n")
+	start := time.Now()
+	slot := proxy.waitForHistory(t, proxy.grab(t, findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Red Bar"}}), "Red Bar")))
+	if slot.Status != "Failed" || !strings.Contains(slot.FailMessage, "timed out") {
+		t.Errorf("a script running too long should fail the job, got %+v", slot)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("script wasn't stopped at the timeout")
+	}
+}
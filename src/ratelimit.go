@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows rate requests per second with bursts of up to burst requests.
+// A rate of 0 doesn't limit at all, but still honors backoff. A nil bucket never limits.
+type tokenBucket struct {
+	mu           sync.Mutex
+	rate         float64
+	burst        float64
+	tokens       float64
+	last         time.Time
+	blockedUntil time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// reserve takes a token and returns how long the caller has to wait before using it
+func (b *tokenBucket) reserve() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	if b.rate > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+		b.tokens--
+		if b.tokens < 0 {
+			wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+		}
+	}
+	if blocked := b.blockedUntil.Sub(now); blocked > wait {
+		wait = blocked
+	}
+	return wait
+}
+
+func (b *tokenBucket) wait() time.Duration {
+	wait := b.reserve()
+	time.Sleep(wait)
+	return wait
+}
+
+// backoff stops handing out tokens until the given time has passed, e.g. after a 429
+func (b *tokenBucket) backoff(until time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until.After(b.blockedUntil) {
+		b.blockedUntil = until
+	}
+}
+
+func (b *tokenBucket) blocked() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Now().Before(b.blockedUntil)
+}
+
+var GlobalLimiter *tokenBucket
+var MirrorRate float64
+var MirrorBurst int
+var mirrorLimiters = map[string]*tokenBucket{}
+var mirrorLimitersMutex sync.Mutex
+
+// MaxRetryAfter caps how long a single Retry-After header can block a mirror
+const MaxRetryAfter = 10 * time.Minute
+
+func setupRateLimits() {
+	globalRate, err := parseRate(getEnv("RATE_LIMIT", "10"))
+	if err != nil {
+		exitWithError("Invalid RATE_LIMIT", err)
+	}
+	globalBurst, err := parseBurst(getEnv("RATE_LIMIT_BURST", "10"))
+	if err != nil {
+		exitWithError("Invalid RATE_LIMIT_BURST", err)
+	}
+	if MirrorRate, err = parseRate(getEnv("MIRROR_RATE_LIMIT", "2")); err != nil {
+		exitWithError("Invalid MIRROR_RATE_LIMIT", err)
+	}
+	if MirrorBurst, err = parseBurst(getEnv("MIRROR_RATE_LIMIT_BURST", "4")); err != nil {
+		exitWithError("Invalid MIRROR_RATE_LIMIT_BURST", err)
+	}
+	GlobalLimiter = newTokenBucket(globalRate, globalBurst)
+	slog.Info("Upstream rate limits", "global_rate", globalRate, "global_burst", globalBurst, "mirror_rate", MirrorRate, "mirror_burst", MirrorBurst)
+}
+
+// parseRate reads requests per second, 0 turning the limit off
+func parseRate(value string) (float64, error) {
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 || math.IsNaN(rate) || math.IsInf(rate, 0) {
+		return 0, fmt.Errorf("%q isn't a number of requests per second", value)
+	}
+	return rate, nil
+}
+
+func parseBurst(value string) (int, error) {
+	burst, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if burst < 1 {
+		return 0, fmt.Errorf("%q needs to be at least 1", value)
+	}
+	return burst, nil
+}
+
+func mirrorLimiter(link string) *tokenBucket {
+	mirrorLimitersMutex.Lock()
+	defer mirrorLimitersMutex.Unlock()
+	limiter, ok := mirrorLimiters[link]
+	if !ok {
+		limiter = newTokenBucket(MirrorRate, MirrorBurst)
+		mirrorLimiters[link] = limiter
+	}
+	return limiter
+}
+
+// pickMirror returns the first mirror from start on that isn't backing off, or the start mirror if all of them are
+func pickMirror(start int) string {
+	for i := 0; i < len(ApiLink); i++ {
+		link := ApiLink[(start+i)%len(ApiLink)]
+		if !mirrorLimiter(link).blocked() {
+			return link
+		}
+	}
+	return ApiLink[start%len(ApiLink)]
+}
+
+// throttle blocks until both the mirror's and the global limiter allow another request
+func throttle(link string) {
+	waited := mirrorLimiter(link).wait()
+	waited += GlobalLimiter.wait()
+	if waited >= time.Second {
+		slog.Info("Rate limited", "mirror", link, "waited", waited.Round(time.Millisecond))
+	}
+}
+
+// retryAfter parses a Retry-After header, either in seconds or as an HTTP date
+func retryAfter(resp *http.Response, fallback time.Duration) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	wait := fallback
+	if seconds, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		wait = time.Until(date)
+	}
+	return min(max(wait, 0), MaxRetryAfter)
+}
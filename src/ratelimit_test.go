@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketBurstThenRate(t *testing.T) {
+	bucket := newTokenBucket(10, 2)
+	if bucket.reserve() != 0 || bucket.reserve() != 0 {
+		t.Fatal("burst should be free")
+	}
+	if wait := bucket.reserve(); wait < 50*time.Millisecond || wait > 100*time.Millisecond {
+		t.Errorf("third request should wait about 100ms, got %v", wait)
+	}
+	if wait := bucket.reserve(); wait < 150*time.Millisecond {
+		t.Errorf("fourth request should queue behind the third, got %v", wait)
+	}
+}
+
+func TestTokenBucketBackoff(t *testing.T) {
+	bucket := newTokenBucket(0, 1)
+	if bucket.reserve() != 0 {
+		t.Fatal("rate 0 shouldn't limit")
+	}
+	bucket.backoff(time.Now().Add(time.Second))
+	if !bucket.blocked() {
+		t.Error("bucket should be blocked")
+	}
+	if wait := bucket.reserve(); wait < 900*time.Millisecond {
+		t.Errorf("expected to wait out the backoff, got %v", wait)
+	}
+	var unlimited *tokenBucket
+	if unlimited.reserve() != 0 || unlimited.blocked() {
+		t.Error("nil bucket shouldn't limit")
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	if rate, err := parseRate("2.5"); err != nil || rate != 2.5 {
+		t.Errorf("expected 2.5, got %v, %v", rate, err)
+	}
+	if rate, err := parseRate("0"); err != nil || rate != 0 {
+		t.Errorf("0 should turn the limit off, got %v, %v", rate, err)
+	}
+	for _, value := range []string{"5/s", "-1", "NaN", ""} {
+		if rate, err := parseRate(value); err == nil {
+			t.Errorf("rate %q should be rejected, got %v", value, rate)
+		}
+	}
+	if burst, err := parseBurst("4"); err != nil || burst != 4 {
+		t.Errorf("expected 4, got %v, %v", burst, err)
+	}
+	for _, value := range []string{"4.5", "0", "ten"} {
+		if burst, err := parseBurst(value); err == nil {
+			t.Errorf("burst %q should be rejected, got %v", value, burst)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	if wait := retryAfter(resp, 5*time.Second); wait != 5*time.Second {
+		t.Errorf("expected fallback, got %v", wait)
+	}
+	resp.Header.Set("Retry-After", "7")
+	if wait := retryAfter(resp, 0); wait != 7*time.Second {
+		t.Errorf("expected 7s, got %v", wait)
+	}
+	resp.Header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if wait := retryAfter(resp, 0); wait < 58*time.Second || wait > time.Minute {
+		t.Errorf("expected about a minute, got %v", wait)
+	}
+	resp.Header.Set("Retry-After", "86400")
+	if wait := retryAfter(resp, 0); wait != MaxRetryAfter {
+		t.Errorf("expected cap, got %v", wait)
+	}
+}
+
+func TestSearchHonorsRetryAfter(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	proxy.Upstream.Throttle(1)
+	start := time.Now()
+	rss := proxy.search(t, url.Values{"t": {"search"}, "q": {"Green Bar"}})
+	if len(rss.Channel.Items) != 1 {
+		t.Fatalf("search should succeed after backing off, got %d results", len(rss.Channel.Items))
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %v, before Retry-After passed", elapsed)
+	}
+	if proxy.Upstream.Hits("/search/") != 2 {
+		t.Errorf("expected 2 search requests, got %d", proxy.Upstream.Hits("/search/"))
+	}
+}
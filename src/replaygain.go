@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.senan.xyz/taglib"
+)
+
+// ReplayGain tags are written once every track of an album is in place, since the album gain needs all of them.
+// "tidal" trusts the gain and peak Tidal reports, "analyze" measures EBU R128 loudness with ffmpeg.
+
+var ReplayGainMode string
+
+// ReplayGain 2.0 reference loudness, Opus' R128 gains are relative to -23 LUFS instead
+const replayGainReference = -18.0
+const r128Reference = -23.0
+
+type loudness struct {
+	TrackGain float64
+	TrackPeak float64
+	AlbumGain float64
+	AlbumPeak float64
+}
+
+func setupReplayGain() {
+	ReplayGainMode = strings.ToLower(getEnv("REPLAYGAIN", "off"))
+	switch ReplayGainMode {
+	case "off", "none", "":
+		ReplayGainMode = ""
+	case "tidal":
+	case "analyze":
+		if _, err := exec.LookPath(FfmpegPath); err != nil {
+			exitWithError("REPLAYGAIN=analyze needs ffmpeg", err)
+		}
+	default:
+		exitWithError("Invalid REPLAYGAIN", fmt.Errorf("%q isn't one of off, tidal or analyze", ReplayGainMode))
+	}
+}
+
+// gainTags formats loudness as tags for a file. Opus only gets R128 gains, as its spec asks players to ignore
+// REPLAYGAIN tags.
+func gainTags(extension string, gain loudness) map[string][]string {
+	if strings.EqualFold(extension, ".opus") {
+		r128 := func(gain float64) []string {
+			return []string{strconv.Itoa(int(math.Round((gain + r128Reference - replayGainReference) * 256)))}
+		}
+		return map[string][]string{
+			"R128_TRACK_GAIN": r128(gain.TrackGain),
+			"R128_ALBUM_GAIN": r128(gain.AlbumGain),
+		}
+	}
+	return map[string][]string{
+		"REPLAYGAIN_TRACK_GAIN": {fmt.Sprintf("%.2f dB", gain.TrackGain)},
+		"REPLAYGAIN_TRACK_PEAK": {fmt.Sprintf("%.6f", gain.TrackPeak)},
+		"REPLAYGAIN_ALBUM_GAIN": {fmt.Sprintf("%.2f dB", gain.AlbumGain)},
+		"REPLAYGAIN_ALBUM_PEAK": {fmt.Sprintf("%.6f", gain.AlbumPeak)},
+	}
+}
+
+// albumLoudness combines track gains into the album's, weighting each track's energy by its duration
+func albumLoudness(gains []loudness, durations []int) (gain float64, peak float64) {
+	var energy, total float64
+	for i, track := range gains {
+		duration := float64(max(durations[i], 1))
+		energy += duration * math.Pow(10, (replayGainReference-track.TrackGain)/10)
+		total += duration
+		peak = max(peak, track.TrackPeak)
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	return replayGainReference - 10*math.Log10(energy/total), peak
+}
+
+// tidalLoudness uses the values Tidal returned with the album and the track manifests
+func tidalLoudness(download Download) []loudness {
+	gains := make([]loudness, len(download.Files))
+	var durations []int
+	albumGain, albumPeak, haveAlbum := 0.0, 0.0, false
+	for i, track := range download.Files {
+		gains[i] = loudness{TrackGain: track.replayGain, TrackPeak: track.peak}
+		durations = append(durations, track.duration)
+		if track.albumPeak > 0 {
+			albumGain, albumPeak, haveAlbum = track.albumReplayGain, track.albumPeak, true
+		}
+	}
+	//tracks resumed after a restart never fetched their manifest, so the album values may be missing
+	if !haveAlbum {
+		albumGain, albumPeak = albumLoudness(gains, durations)
+	}
+	for i := range gains {
+		gains[i].AlbumGain, gains[i].AlbumPeak = albumGain, albumPeak
+	}
+	return gains
+}
+
+var integratedPattern = regexp.MustCompile(`I:\s+(-?[0-9.]+|-inf) LUFS`)
+var truePeakPattern = regexp.MustCompile(`Peak:\s+(-?[0-9.]+|-inf) dBFS`)
+
+// measureLoudness runs ffmpeg's ebur128 filter over one or more files, as one stream, and returns the ReplayGain
+// gain and linear true peak
+func measureLoudness(paths []string) (gain float64, peak float64, err error) {
+	var args []string
+	var inputs string
+	for i, path := range paths {
+		args = append(args, "-i", path)
+		inputs += "[" + strconv.Itoa(i) + ":a]"
+	}
+	filter := inputs + "concat=n=" + strconv.Itoa(len(paths)) + ":v=0:a=1,ebur128=peak=true:framelog=verbose"
+	args = append([]string{"-hide_banner", "-nostats", "-loglevel", "info"}, args...)
+	args = append(args, "-filter_complex", filter, "-f", "null", "-")
+
+	ctx, cancel := context.WithTimeout(context.Background(), transcodeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, FfmpegPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return 0, 0, fmt.Errorf("ffmpeg loudness analysis failed: %w: %s", err, lastLine(stderr.String()))
+	}
+	integrated := integratedPattern.FindAllStringSubmatch(stderr.String(), -1)
+	truePeak := truePeakPattern.FindAllStringSubmatch(stderr.String(), -1)
+	if len(integrated) == 0 || len(truePeak) == 0 {
+		return 0, 0, errors.New("no loudness summary in ffmpeg's output")
+	}
+	lufs, _ := strconv.ParseFloat(integrated[len(integrated)-1][1], 64)
+	dbfs, _ := strconv.ParseFloat(truePeak[len(truePeak)-1][1], 64)
+	if math.IsInf(lufs, -1) {
+		//silence, leave it alone
+		return 0, math.Pow(10, dbfs/20), nil
+	}
+	return replayGainReference - lufs, math.Pow(10, dbfs/20), nil
+}
+
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return lines[len(lines)-1]
+}
+
+// analyzeLoudness measures every track, then the album as a whole
+func analyzeLoudness(paths []string) ([]loudness, error) {
+	gains := make([]loudness, len(paths))
+	for i, path := range paths {
+		var err error
+		gains[i].TrackGain, gains[i].TrackPeak, err = measureLoudness([]string{path})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+	}
+	albumGain, albumPeak, err := measureLoudness(paths)
+	if err != nil {
+		return nil, err
+	}
+	for i := range gains {
+		gains[i].AlbumGain, gains[i].AlbumPeak = albumGain, albumPeak
+	}
+	return gains, nil
+}
+
+// writeReplayGain tags every track of a finished album in folder
+func writeReplayGain(download Download, folder string) error {
+	if ReplayGainMode == "" || len(download.Files) == 0 {
+		return nil
+	}
+	start := time.Now()
+	var paths []string
+	for _, track := range download.Files {
+		paths = append(paths, filepath.Join(folder, trackFileName(download, track)+outputExtension()))
+	}
+	var gains []loudness
+	if ReplayGainMode == "analyze" {
+		var err error
+		if gains, err = analyzeLoudness(paths); err != nil {
+			return err
+		}
+	} else {
+		gains = tidalLoudness(download)
+	}
+	for i, path := range paths {
+		if err := taglib.WriteTags(path, gainTags(filepath.Ext(path), gains[i]), 0); err != nil {
+			return fmt.Errorf("couldn't write ReplayGain tags to %s: %w", filepath.Base(path), err)
+		}
+	}
+	slog.Debug("Wrote ReplayGain tags", "nzo_id", "SABnzbd_nzo_"+download.Id, "mode", ReplayGainMode, "album_gain", gains[0].AlbumGain, "duration", time.Since(start))
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"go.senan.xyz/taglib"
+)
+
+func useReplayGain(t *testing.T, mode string) {
+	t.Helper()
+	oldMode, oldFfmpeg := ReplayGainMode, FfmpegPath
+	t.Cleanup(func() {
+		ReplayGainMode, FfmpegPath = oldMode, oldFfmpeg
+	})
+	if mode == "analyze" {
+		FfmpegPath = filepath.Join(filepath.Dir(fakeFfmpeg(t)), "ffmpeg")
+	}
+	ReplayGainMode = mode
+}
+
+func grabAndReadTags(t *testing.T, proxy *testProxy) map[string][]string {
+	t.Helper()
+	item := findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Green Bar"}}), "Green Bar")
+	slot := proxy.waitForHistory(t, proxy.grab(t, item))
+	if slot.Status != "Completed" {
+		t.Fatalf("download failed: %+v", slot)
+	}
+	tags, err := taglib.ReadTags(filepath.Join(slot.Storage, "02 - The Testers - Teardown.flac"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tags
+}
+
+func checkTags(t *testing.T, tags map[string][]string, expected map[string]string) {
+	t.Helper()
+	for key, value := range expected {
+		if len(tags[key]) != 1 || tags[key][0] != value {
+			t.Errorf("%s: expected %q, got %v", key, value, tags[key])
+		}
+	}
+}
+
+func TestReplayGainFromTidal(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	useReplayGain(t, "tidal")
+	checkTags(t, grabAndReadTags(t, proxy), map[string]string{
+		"REPLAYGAIN_TRACK_GAIN": "-7.50 dB",
+		"REPLAYGAIN_TRACK_PEAK": "0.980000",
+		"REPLAYGAIN_ALBUM_GAIN": "-8.10 dB",
+		"REPLAYGAIN_ALBUM_PEAK": "0.990000",
+		taglib.Title:            "Teardown",
+	})
+}
+
+func TestReplayGainAnalyzed(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	useReplayGain(t, "analyze")
+	checkTags(t, grabAndReadTags(t, proxy), map[string]string{
+		"REPLAYGAIN_TRACK_GAIN": "-6.00 dB",
+		"REPLAYGAIN_TRACK_PEAK": "0.891251",
+		"REPLAYGAIN_ALBUM_GAIN": "-6.00 dB",
+	})
+}
+
+func TestReplayGainOff(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	useReplayGain(t, "")
+	if tags := grabAndReadTags(t, proxy); len(tags["REPLAYGAIN_TRACK_GAIN"]) != 0 {
+		t.Errorf("ReplayGain written while off: %v", tags)
+	}
+}
+
+func TestOpusGetsR128Gains(t *testing.T) {
+	tags := gainTags(".opus", loudness{TrackGain: -7.5, TrackPeak: 0.98, AlbumGain: 2})
+	// -7.5 dB at -18 LUFS is -12.5 dB at -23 LUFS, in 1/256 dB
+	if tags["R128_TRACK_GAIN"][0] != "-3200" || tags["R128_ALBUM_GAIN"][0] != "-768" {
+		t.Errorf("unexpected R128 gains %v", tags)
+	}
+	if _, ok := tags["REPLAYGAIN_TRACK_GAIN"]; ok {
+		t.Error("Opus shouldn't get REPLAYGAIN tags")
+	}
+}
+
+func TestAlbumLoudnessFallback(t *testing.T) {
+	gain, peak := albumLoudness([]loudness{{TrackGain: -6, TrackPeak: 0.5}, {TrackGain: -6, TrackPeak: 0.9}}, []int{100, 300})
+	if math.Abs(gain+6) > 0.001 || peak != 0.9 {
+		t.Errorf("equal tracks should give the same album gain, got %f %f", gain, peak)
+	}
+	gain, _ = albumLoudness([]loudness{{TrackGain: 0}, {TrackGain: -10}}, []int{100, 100})
+	if gain > -7 || gain < -8 {
+		t.Errorf("the louder track should dominate the album gain, got %f", gain)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lidarr's RSS sync asks the indexer with an empty query. With RSS_ARTISTS (names or Tidal artist IDs) or
+// RSS_FROM_LIDARR (every monitored artist in Lidarr) set, that answer lists the artists' releases of the last
+// RSS_DAYS, newest first, so Lidarr picks up new albums on its own. The discographies are read in the background every
+// RSS_REFRESH, since Lidarr wouldn't wait for hundreds of artists.
+
+var RssArtists []string
+var RssFromLidarr bool
+var RssRefresh time.Duration = time.Hour
+var RssDays int = 90
+var RssMaxItems int = 100
+
+var rssFeed []Album
+var rssFeedMutex sync.Mutex
+
+func setupRssFeed() {
+	for _, artist := range strings.Split(getEnv("RSS_ARTISTS", ""), ",") {
+		if artist = strings.TrimSpace(artist); artist != "" {
+			RssArtists = append(RssArtists, artist)
+		}
+	}
+	RssFromLidarr = strings.EqualFold(getEnv("RSS_FROM_LIDARR", "false"), "true")
+	var err error
+	if RssRefresh, err = time.ParseDuration(getEnv("RSS_REFRESH", "1h")); err != nil || RssRefresh < time.Minute {
+		exitWithError("Invalid RSS_REFRESH", errors.New("needs to be a duration of at least 1m"))
+	}
+	if RssDays, err = strconv.Atoi(getEnv("RSS_DAYS", "90")); err != nil || RssDays < 1 {
+		exitWithError("Invalid RSS_DAYS", errors.New("needs to be 1 or more"))
+	}
+	if RssMaxItems, err = strconv.Atoi(getEnv("RSS_MAX_ITEMS", "100")); err != nil || RssMaxItems < 1 {
+		exitWithError("Invalid RSS_MAX_ITEMS", errors.New("needs to be 1 or more"))
+	}
+	if RssFromLidarr && LidarrUrl == "" {
+		exitWithError("Invalid RSS_FROM_LIDARR", errors.New("reading Lidarr's artists needs LIDARR_URL and LIDARR_API_KEY"))
+	}
+	if len(RssArtists) == 0 && !RssFromLidarr {
+		return
+	}
+	slog.Info("RSS feed enabled", "artists", len(RssArtists), "from_lidarr", RssFromLidarr, "refresh", RssRefresh, "days", RssDays)
+	go func() {
+		for !stopping.Load() {
+			if err := refreshRssFeed(); err != nil {
+				slog.Warn("Couldn't refresh the RSS feed", "error", err)
+			}
+			time.Sleep(RssRefresh)
+		}
+	}()
+}
+
+// rssFeedAlbums returns the releases found by the last refresh
+func rssFeedAlbums() []Album {
+	rssFeedMutex.Lock()
+	defer rssFeedMutex.Unlock()
+	return rssFeed
+}
+
+// refreshRssFeed reads every artist's discography and keeps their recent releases
+func refreshRssFeed() error {
+	start := time.Now()
+	artists, err := rssFeedArtists()
+	if err != nil {
+		return err
+	}
+	oldest := time.Now().AddDate(0, 0, -RssDays).Format("2006-01-02")
+	today := time.Now().Format("2006-01-02")
+	seen := map[string]bool{}
+	var albums []Album
+	failed := 0
+	for _, artist := range artists {
+		if stopping.Load() {
+			return nil
+		}
+		Id, err := findArtistId(artist)
+		if err == nil {
+			var discography []Album
+			if discography, err = artistAlbums(Id); err == nil {
+				for _, album := range discography {
+					//unreleased albums can't be downloaded yet
+					if len(album.ReleaseDate) < 10 || album.ReleaseDate < oldest || album.ReleaseDate > today || seen[album.Id] {
+						continue
+					}
+					seen[album.Id] = true
+					albums = append(albums, album)
+				}
+			}
+		}
+		if err != nil {
+			failed++
+			slog.Debug("Couldn't read an artist for the RSS feed", "artist", artist, "error", err)
+		}
+	}
+	sort.SliceStable(albums, func(i, j int) bool { return albums[i].ReleaseDate > albums[j].ReleaseDate })
+	if len(albums) > RssMaxItems {
+		albums = albums[:RssMaxItems]
+	}
+	rssFeedMutex.Lock()
+	rssFeed = albums
+	rssFeedMutex.Unlock()
+	slog.Info("RSS feed refreshed", "artists", len(artists), "failed", failed, "releases", len(albums), "duration", time.Since(start))
+	return nil
+}
+
+// rssFeedArtists lists RSS_ARTISTS and, with RSS_FROM_LIDARR, Lidarr's monitored artists
+func rssFeedArtists() ([]string, error) {
+	artists := append([]string{}, RssArtists...)
+	if !RssFromLidarr {
+		return artists, nil
+	}
+	var lidarrArtists []struct {
+		ArtistName string `json:"artistName"`
+		Monitored  bool   `json:"monitored"`
+	}
+	if err := lidarrRequest(http.MethodGet, "/api/v1/artist", nil, &lidarrArtists); err != nil {
+		return nil, fmt.Errorf("couldn't read Lidarr's artists: %w", err)
+	}
+	for _, artist := range lidarrArtists {
+		if artist.Monitored && artist.ArtistName != "" {
+			artists = append(artists, artist.ArtistName)
+		}
+	}
+	return artists, nil
+}
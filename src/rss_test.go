@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// useRssFeed follows artists, starting from an empty feed
+func useRssFeed(t *testing.T, fromLidarr bool, artists ...string) {
+	t.Helper()
+	oldArtists, oldFromLidarr, oldDays, oldMax := RssArtists, RssFromLidarr, RssDays, RssMaxItems
+	reset := func() {
+		rssFeedMutex.Lock()
+		rssFeed = nil
+		rssFeedMutex.Unlock()
+		artistIdsMutex.Lock()
+		artistIds = map[string]string{}
+		artistIdsMutex.Unlock()
+	}
+	t.Cleanup(func() {
+		RssArtists, RssFromLidarr, RssDays, RssMaxItems = oldArtists, oldFromLidarr, oldDays, oldMax
+		reset()
+	})
+	RssArtists, RssFromLidarr, RssDays, RssMaxItems = artists, fromLidarr, 90, 100
+	reset()
+}
+
+func daysAgo(days int) string {
+	return time.Now().AddDate(0, 0, -days).Format("2006-01-02")
+}
+
+func rssAlbums() []fakeAlbum {
+	track := []fakeTrack{{Id: 91, Title: "One", TrackNumber: 1, VolumeNumber: 1, Duration: 1}}
+	return []fakeAlbum{
+		{Id: "2001", Artist: "The Testers", Title: "Last Week", ReleaseDate: daysAgo(7), Tracks: track},
+		{Id: "2002", Artist: "The Testers", Title: "Yesterday", ReleaseDate: daysAgo(1), Tracks: track},
+		{Id: "2003", Artist: "The Testers", Title: "Long Ago", ReleaseDate: "2001-01-01", Tracks: track},
+		{Id: "2004", Artist: "The Testers", Title: "Next Month", ReleaseDate: daysAgo(-30), Tracks: track},
+		{Id: "2005", Artist: "Other Band", ArtistId: "600", Title: "Their New One", ReleaseDate: daysAgo(3), Tracks: track},
+	}
+}
+
+func TestRssFeedListsRecentReleases(t *testing.T) {
+	proxy := newTestProxy(t, "flac", rssAlbums()...)
+	useRssFeed(t, false, "the testers", "600", "Nobody")
+
+	if err := refreshRssFeed(); err != nil {
+		t.Fatal(err)
+	}
+	rss := proxy.search(t, map[string][]string{"t": {"search"}})
+	var titles []string
+	for _, item := range rss.Channel.Items {
+		titles = append(titles, item.Description)
+	}
+	if len(titles) != 3 || titles[0] != "The Testers Yesterday" || titles[1] != "Other Band Their New One" || titles[2] != "The Testers Last Week" {
+		t.Fatalf("expected the three recent releases, newest first, got %v", titles)
+	}
+	if rss.Channel.Items[0].Enclosure.Url == "" {
+		t.Error("feed items need to be grabbable")
+	}
+
+	// artists found are only looked up once, those missing on every refresh
+	refreshRssFeed()
+	if hits := proxy.Upstream.Hits("/search/"); hits != 3 {
+		t.Errorf("expected 3 artist lookups, got %d", hits)
+	}
+}
+
+func TestRssFeedFromLidarrArtists(t *testing.T) {
+	proxy := newTestProxy(t, "flac", rssAlbums()...)
+	lidarr := useLidarr(t, true)
+	useRssFeed(t, true)
+	RssMaxItems = 1
+	lidarr.artists = []map[string]any{
+		{"artistName": "Other Band", "monitored": true},
+		{"artistName": "The Testers", "monitored": false},
+	}
+
+	if err := refreshRssFeed(); err != nil {
+		t.Fatal(err)
+	}
+	rss := proxy.search(t, map[string][]string{"t": {"music"}})
+	if len(rss.Channel.Items) != 1 || rss.Channel.Items[0].Description != "Other Band Their New One" {
+		t.Errorf("expected only the monitored artist's release, got %+v", rss.Channel.Items)
+	}
+}
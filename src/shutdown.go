@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// On SIGTERM we stop taking grabs, give running tracks ShutdownGrace to finish, then write every unfinished job to a
+// checkpoint next to the incomplete folders. The next start picks the jobs up again instead of deleting their folders.
+
+var ShutdownGrace time.Duration
+var stopping atomic.Bool
+var activeJobs atomic.Int32
+
+// closed once stopping, for waits that shouldn't outlast ShutdownGrace
+var stopCh = make(chan struct{})
+var stopMutex sync.Mutex
+
+var errInterrupted = errors.New("interrupted by shutdown")
+
+type checkpointJob struct {
+	Id              string    `json:"id"`
+	FileName        string    `json:"file_name"`
+	NumTracks       int       `json:"num_tracks"`
+	Added           time.Time `json:"added"`
+	CompletedTracks []int     `json:"completed_tracks"`
+}
+
+func setupShutdown() {
+	var err error
+	ShutdownGrace, err = time.ParseDuration(getEnv("SHUTDOWN_GRACE", "30s"))
+	if err != nil {
+		exitWithError("Invalid SHUTDOWN_GRACE", err)
+	}
+}
+
+func checkpointPath() string {
+	return filepath.Join(DownloadPath, "incomplete", Category, ".tidlarr-queue.json")
+}
+
+// stopSignal is closed once the shutdown starts
+func stopSignal() <-chan struct{} {
+	stopMutex.Lock()
+	defer stopMutex.Unlock()
+	return stopCh
+}
+
+// drainWorkers stops the workers from starting new tracks and waits for the current ones, at most grace.
+// Returns false if some were still running.
+func drainWorkers(grace time.Duration) bool {
+	stopMutex.Lock()
+	if !stopping.Swap(true) {
+		close(stopCh)
+	}
+	stopMutex.Unlock()
+	deadline := time.Now().Add(grace)
+	for activeJobs.Load() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+// saveCheckpoint writes every job that isn't finished yet, with the tracks it already has
+func saveCheckpoint() error {
+	var checkpoint []checkpointJob
+	DownloadsMutex.Lock()
+	for _, download := range Downloads {
+		//an album Lidarr is importing is already complete, the history picks it up from its folder
+		if download.Status == StatusCompleted || download.Status == StatusFailed || download.importStatus == ImportRunning {
+			continue
+		}
+		job := checkpointJob{Id: download.Id, FileName: download.FileName, NumTracks: download.numTracks, Added: download.added, CompletedTracks: []int{}}
+		//a resumed job that didn't get to fetch its album yet only knows its tracks from the last checkpoint
+		completed := map[int]bool{}
+		for Id := range download.resumeTracks {
+			completed[Id] = true
+		}
+		for _, track := range download.Files {
+			if track.completed {
+				completed[track.Id] = true
+			}
+		}
+		for Id := range completed {
+			job.CompletedTracks = append(job.CompletedTracks, Id)
+		}
+		sort.Ints(job.CompletedTracks)
+		checkpoint = append(checkpoint, job)
+	}
+	DownloadsMutex.Unlock()
+	sort.Slice(checkpoint, func(i, j int) bool {
+		return checkpoint[i].Added.Before(checkpoint[j].Added)
+	})
+
+	if len(checkpoint) == 0 {
+		err := os.Remove(checkpointPath())
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp := checkpointPath() + ".tmp"
+	if err := os.WriteFile(temp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, checkpointPath())
+}
+
+// loadCheckpoint reads the jobs left by the last shutdown. The checkpoint is removed, it's rewritten on the next one.
+func loadCheckpoint() []checkpointJob {
+	data, err := os.ReadFile(checkpointPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Couldn't read queue checkpoint", "error", err)
+		}
+		return nil
+	}
+	var checkpoint []checkpointJob
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		slog.Error("Couldn't parse queue checkpoint", "error", err)
+		return nil
+	}
+	os.Remove(checkpointPath())
+	return checkpoint
+}
+
+// resumeJobs queues the checkpointed jobs again, in their original order
+func resumeJobs(checkpoint []checkpointJob) {
+	for _, job := range checkpoint {
+		download := &Download{
+			Id:           job.Id,
+			FileName:     job.FileName,
+			numTracks:    job.NumTracks,
+			hasLyrics:    true,
+			Status:       StatusQueued,
+			added:        job.Added,
+			resumeTracks: map[int]bool{},
+		}
+		for _, Id := range job.CompletedTracks {
+			download.resumeTracks[Id] = true
+		}
+		DownloadsMutex.Lock()
+		Downloads[job.Id] = download
+		DownloadsMutex.Unlock()
+		slog.Info("Resuming download", "nzo_id", "SABnzbd_nzo_"+job.Id, "album_id", job.Id, "completed_tracks", len(job.CompletedTracks))
+		enqueue(job.Id)
+	}
+}
+
+// shutdown finishes or checkpoints running jobs, then stops the HTTP server
+func shutdown(server *http.Server) {
+	slog.Info("Shutting down", "grace", ShutdownGrace)
+	if !drainWorkers(ShutdownGrace) {
+		slog.Warn("Grace period over, tracks still downloading will be fetched again on the next start")
+	}
+	if err := saveCheckpoint(); err != nil {
+		slog.Error("Couldn't write queue checkpoint", "error", err)
+	}
+	if err := saveStats(); err != nil {
+		slog.Error("Couldn't write download statistics", "error", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("HTTP server didn't stop cleanly", "error", err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func resetStopping(t *testing.T) {
+	t.Cleanup(func() {
+		stopMutex.Lock()
+		stopping.Store(false)
+		stopCh = make(chan struct{})
+		stopMutex.Unlock()
+	})
+}
+
+func TestShutdownCheckpointsRunningJob(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	resetStopping(t)
+	release := proxy.Upstream.Stall("/media/12.flac")
+
+	item := findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Green Bar"}}), "Green Bar")
+	nzoId := proxy.grab(t, item)
+	for deadline := time.Now().Add(10 * time.Second); proxy.Upstream.Hits("/media/12.flac") == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("second track never started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if drainWorkers(100 * time.Millisecond) {
+		t.Error("drain shouldn't finish while a track is stuck")
+	}
+	if err := saveCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	checkpoint := loadCheckpoint()
+	if len(checkpoint) != 1 || "SABnzbd_nzo_"+checkpoint[0].Id != nzoId {
+		t.Fatalf("unexpected checkpoint %+v", checkpoint)
+	}
+	if len(checkpoint[0].CompletedTracks) != 1 || checkpoint[0].CompletedTracks[0] != 11 {
+		t.Errorf("expected only the first track to be done, got %v", checkpoint[0].CompletedTracks)
+	}
+
+	result := proxy.addfile(t, "Another", []byte(proxy.get(t, "/indexer", url.Values{"t": {"fakenzb"}, "tidalid": {"1002"}, "numtracks": {"1"}})))
+	if result["status"] != false || result["http_status"] != float64(http.StatusServiceUnavailable) {
+		t.Errorf("grabs should be refused while shutting down, got %v", result)
+	}
+
+	//let the stuck track finish so nothing writes to the download folder after the test
+	release()
+	if !drainWorkers(10 * time.Second) {
+		t.Error("job didn't stop after its track finished")
+	}
+}
+
+func TestResumeFromCheckpoint(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	name := "The Testers-Green Bar-16BIT-44-KHZ-WEB-FLAC-2021-TIDLARR"
+	folder := filepath.Join(DownloadPath, "incomplete", Category, name)
+	os.MkdirAll(folder, 0755)
+	os.WriteFile(filepath.Join(folder, "01 - The Testers - Setup.flac"), proxy.Upstream.Flac, 0644)
+	os.MkdirAll(filepath.Join(DownloadPath, "incomplete", Category, "Leftover-TIDLARR"), 0755)
+
+	DownloadsMutex.Lock()
+	Downloads["1001"] = &Download{Id: "1001", FileName: name, numTracks: 2, Status: StatusDownloading, added: time.Now(),
+		Files: []File{{Id: 11, completed: true}, {Id: 12}}}
+	DownloadsMutex.Unlock()
+	if err := saveCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	//pretend to restart
+	DownloadsMutex.Lock()
+	Downloads = make(map[string]*Download)
+	DownloadsMutex.Unlock()
+	checkpoint := loadCheckpoint()
+	cleanIncomplete(checkpoint)
+	if _, err := os.Stat(folder); err != nil {
+		t.Fatal("checkpointed folder was cleaned up")
+	}
+	if _, err := os.Stat(filepath.Join(DownloadPath, "incomplete", Category, "Leftover-TIDLARR")); !os.IsNotExist(err) {
+		t.Error("unrelated leftovers should still be cleaned up")
+	}
+	resumeJobs(checkpoint)
+
+	if slot := proxy.waitForHistory(t, "SABnzbd_nzo_1001"); slot.Status != StatusCompleted {
+		t.Fatalf("resumed download failed: %+v", slot)
+	}
+	if proxy.Upstream.Hits("/media/11.flac") != 0 || proxy.Upstream.Hits("/media/12.flac") != 1 {
+		t.Errorf("only the missing track should be downloaded, got %d and %d", proxy.Upstream.Hits("/media/11.flac"), proxy.Upstream.Hits("/media/12.flac"))
+	}
+	if _, err := os.Stat(checkpointPath()); !os.IsNotExist(err) {
+		t.Error("checkpoint should be consumed")
+	}
+}
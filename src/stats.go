@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Download totals per day, kept in DOWNLOAD_PATH so they survive restarts, answer SABnzbd's server_stats and
+// fullstatus. The upstream mirrors stand in for SABnzbd's news servers: per mirror we count the bytes it answered with,
+// the requests sent to it and how many of those succeeded.
+
+const dayFormat = "2006-01-02"
+
+const statsSaveInterval = time.Minute
+
+// how many warnings mode=warnings keeps
+const maxWarnings = 50
+
+type mirrorStats struct {
+	Daily   map[string]int64 `json:"daily"`
+	Tried   map[string]int64 `json:"tried"`
+	Success map[string]int64 `json:"success"`
+	// last failure, only kept while running
+	lastError string
+}
+
+var stats = struct {
+	sync.Mutex
+	Daily   map[string]int64        `json:"daily"`
+	Mirrors map[string]*mirrorStats `json:"mirrors"`
+	saved   time.Time
+}{Daily: map[string]int64{}, Mirrors: map[string]*mirrorStats{}}
+
+var startTime = time.Now()
+
+type Warning struct {
+	Text   string `json:"text"`
+	Type   string `json:"type"`
+	Time   int64  `json:"time"`
+	Origin string `json:"origin"`
+}
+
+var recentWarnings []Warning
+var warningsMutex sync.Mutex
+
+func statsPath() string {
+	return filepath.Join(DownloadPath, ".tidlarr-stats.json")
+}
+
+// loadStats reads the totals saved by the last run
+func loadStats() {
+	data, err := os.ReadFile(statsPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Couldn't read download statistics", "error", err)
+		}
+		return
+	}
+	stats.Lock()
+	defer stats.Unlock()
+	if err := json.Unmarshal(data, &stats); err != nil {
+		slog.Error("Couldn't parse download statistics", "error", err)
+	}
+	if stats.Daily == nil {
+		stats.Daily = map[string]int64{}
+	}
+	if stats.Mirrors == nil {
+		stats.Mirrors = map[string]*mirrorStats{}
+	}
+}
+
+func saveStats() error {
+	stats.Lock()
+	data, err := json.Marshal(&stats)
+	stats.Unlock()
+	if err != nil {
+		return err
+	}
+	temp := statsPath() + ".tmp"
+	if err := os.WriteFile(temp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, statsPath())
+}
+
+// countDownload adds bytes of audio or artwork to today's total. The totals are saved every statsSaveInterval while
+// downloading, so a crash loses little.
+func countDownload(bytes int64) {
+	stats.Lock()
+	stats.Daily[time.Now().Format(dayFormat)] += bytes
+	save := time.Since(stats.saved) > statsSaveInterval
+	if save {
+		stats.saved = time.Now()
+	}
+	stats.Unlock()
+	if save {
+		if err := saveStats(); err != nil {
+			slog.Warn("Couldn't write download statistics", "error", err)
+		}
+	}
+}
+
+// countMirrorRequest records a request to a mirror, with the bytes it answered with. Any error, status included, is
+// a failure.
+func countMirrorRequest(link string, bytes int64, err string) {
+	stats.Lock()
+	defer stats.Unlock()
+	mirror, ok := stats.Mirrors[mirrorLabel(link)]
+	if !ok {
+		mirror = &mirrorStats{Daily: map[string]int64{}, Tried: map[string]int64{}, Success: map[string]int64{}}
+		stats.Mirrors[mirrorLabel(link)] = mirror
+	}
+	today := time.Now().Format(dayFormat)
+	mirror.Daily[today] += bytes
+	mirror.Tried[today]++
+	if err == "" {
+		mirror.Success[today]++
+	}
+	mirror.lastError = err
+}
+
+// addWarning keeps a problem for mode=warnings, dropping the oldest when there are too many
+func addWarning(origin string, text string) {
+	warningsMutex.Lock()
+	defer warningsMutex.Unlock()
+	recentWarnings = append(recentWarnings, Warning{Text: text, Type: "WARNING", Time: time.Now().Unix(), Origin: origin})
+	if len(recentWarnings) > maxWarnings {
+		recentWarnings = recentWarnings[len(recentWarnings)-maxWarnings:]
+	}
+}
+
+func listWarnings() []Warning {
+	warningsMutex.Lock()
+	defer warningsMutex.Unlock()
+	return append([]Warning{}, recentWarnings...)
+}
+
+type periodTotals struct {
+	Total int64 `json:"total"`
+	Month int64 `json:"month"`
+	Week  int64 `json:"week"`
+	Day   int64 `json:"day"`
+}
+
+// sumPeriods adds up daily totals for today, this week (from Monday), this month and all time
+func sumPeriods(daily map[string]int64, now time.Time) periodTotals {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	monday := today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+	var totals periodTotals
+	for key, bytes := range daily {
+		day, err := time.ParseInLocation(dayFormat, key, now.Location())
+		if err != nil {
+			continue
+		}
+		totals.Total += bytes
+		if day.Year() == today.Year() && day.Month() == today.Month() {
+			totals.Month += bytes
+		}
+		if !day.Before(monday) {
+			totals.Week += bytes
+		}
+		if day.Equal(today) {
+			totals.Day += bytes
+		}
+	}
+	return totals
+}
+
+type ServerStats struct {
+	periodTotals
+	Daily           map[string]int64 `json:"daily"`
+	ArticlesTried   map[string]int64 `json:"articles_tried"`
+	ArticlesSuccess map[string]int64 `json:"articles_success"`
+}
+
+type ServerStatsResponse struct {
+	periodTotals
+	Servers map[string]ServerStats `json:"servers"`
+}
+
+func server_stats(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	stats.Lock()
+	resp := ServerStatsResponse{periodTotals: sumPeriods(stats.Daily, now), Servers: map[string]ServerStats{}}
+	for name, mirror := range stats.Mirrors {
+		resp.Servers[name] = ServerStats{
+			periodTotals:    sumPeriods(mirror.Daily, now),
+			Daily:           copyDaily(mirror.Daily),
+			ArticlesTried:   copyDaily(mirror.Tried),
+			ArticlesSuccess: copyDaily(mirror.Success),
+		}
+	}
+	stats.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.Error("Error encoding JSON", "error", err)
+	}
+}
+
+func copyDaily(daily map[string]int64) map[string]int64 {
+	copied := make(map[string]int64, len(daily))
+	for day, value := range daily {
+		copied[day] = value
+	}
+	return copied
+}
+
+type WarningsResponse struct {
+	Warnings []Warning `json:"warnings"`
+}
+
+// warnings answers mode=warnings, or empties the list with name=clear
+func warnings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Query().Get("name") == "clear" {
+		warningsMutex.Lock()
+		recentWarnings = nil
+		warningsMutex.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"status": true})
+		return
+	}
+	if err := json.NewEncoder(w).Encode(WarningsResponse{Warnings: listWarnings()}); err != nil {
+		slog.Error("Error encoding JSON", "error", err)
+	}
+}
+
+func get_cats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"categories": []string{"*", Category}})
+}
+
+type FullStatusServer struct {
+	ServerName       string `json:"servername"`
+	ServerActive     bool   `json:"serveractive"`
+	ServerSsl        int    `json:"serverssl"`
+	ServerError      string `json:"servererror"`
+	ServerPriority   int    `json:"serverpriority"`
+	ServerOptional   bool   `json:"serveroptional"`
+	ServerTotalConn  int    `json:"servertotalconn"`
+	ServerActiveConn int    `json:"serveractiveconn"`
+}
+
+type FullStatus struct {
+	Version         string             `json:"version"`
+	Uptime          string             `json:"uptime"`
+	Pid             int                `json:"pid"`
+	Status          string             `json:"status"`
+	Paused          bool               `json:"paused"`
+	PauseInt        string             `json:"pause_int"`
+	NoOfSlots       int                `json:"noofslots"`
+	KbPerSec        string             `json:"kbpersec"`
+	Speed           string             `json:"speed"`
+	SpeedLimit      string             `json:"speedlimit"`
+	SpeedLimitAbs   string             `json:"speedlimit_abs"`
+	Diskspace1      string             `json:"diskspace1"`
+	Diskspace2      string             `json:"diskspace2"`
+	Diskspacetotal1 string             `json:"diskspacetotal1"`
+	Diskspacetotal2 string             `json:"diskspacetotal2"`
+	DownloadDir     string             `json:"downloaddir"`
+	CompleteDir     string             `json:"completedir"`
+	HaveWarnings    string             `json:"have_warnings"`
+	Warnings        []Warning          `json:"warnings"`
+	DayTotal        int64              `json:"day_size"`
+	WeekTotal       int64              `json:"week_size"`
+	MonthTotal      int64              `json:"month_size"`
+	Total           int64              `json:"total_size"`
+	Servers         []FullStatusServer `json:"servers"`
+}
+
+type FullStatusResponse struct {
+	Status FullStatus `json:"status"`
+}
+
+func fullstatus(w http.ResponseWriter, r *http.Request) {
+	queue := queueState(queueSlots())
+	speed := recentTransfers.speed()
+	resp := FullStatus{
+		Version:         sabVersion,
+		Uptime:          formatUptime(time.Since(startTime)),
+		Pid:             os.Getpid(),
+		Status:          queue.Status,
+		Paused:          queue.Paused,
+		PauseInt:        "0",
+		NoOfSlots:       len(queue.Slots),
+		KbPerSec:        strconv.FormatFloat(speed/1024, 'f', 2, 64),
+		Speed:           formatSpeed(speed),
+		SpeedLimit:      queue.SpeedLimit,
+		SpeedLimitAbs:   queue.SpeedLimitAbs,
+		Diskspace1:      queue.Diskspace1,
+		Diskspace2:      queue.Diskspace2,
+		Diskspacetotal1: queue.Diskspacetotal1,
+		Diskspacetotal2: queue.Diskspacetotal2,
+		DownloadDir:     filepath.Join(DownloadPath, "incomplete"),
+		CompleteDir:     filepath.Join(DownloadPath, "complete"),
+		Warnings:        listWarnings(),
+		Servers:         []FullStatusServer{},
+	}
+	resp.HaveWarnings = strconv.Itoa(len(resp.Warnings))
+
+	stats.Lock()
+	totals := sumPeriods(stats.Daily, time.Now())
+	resp.DayTotal, resp.WeekTotal, resp.MonthTotal, resp.Total = totals.Day, totals.Week, totals.Month, totals.Total
+	for _, link := range ApiLink {
+		server := FullStatusServer{ServerName: mirrorLabel(link), ServerActive: true, ServerTotalConn: 1}
+		if strings.HasPrefix(link, "https://") {
+			server.ServerSsl = 1
+		}
+		if mirror, ok := stats.Mirrors[mirrorLabel(link)]; ok {
+			server.ServerError = mirror.lastError
+		}
+		resp.Servers = append(resp.Servers, server)
+	}
+	stats.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(FullStatusResponse{Status: resp}); err != nil {
+		slog.Error("Error encoding JSON", "error", err)
+	}
+}
+
+// formatUptime writes a duration the way SABnzbd shows it, like "3d 4h" or "12m"
+func formatUptime(uptime time.Duration) string {
+	days, hours, minutes := int(uptime.Hours())/24, int(uptime.Hours())%24, int(uptime.Minutes())%60
+	switch {
+	case days > 0:
+		return strconv.Itoa(days) + "d " + strconv.Itoa(hours) + "h"
+	case hours > 0:
+		return strconv.Itoa(hours) + "h " + strconv.Itoa(minutes) + "m"
+	default:
+		return strconv.Itoa(minutes) + "m"
+	}
+}
+
+// formatSpeed writes bytes per second like SABnzbd's "1.2 M"
+func formatSpeed(speed float64) string {
+	for _, unit := range []string{"", "K", "M", "G"} {
+		if speed < 1024 || unit == "G" {
+			return strconv.FormatFloat(speed, 'f', 1, 64) + " " + unit
+		}
+		speed /= 1024
+	}
+	return ""
+}
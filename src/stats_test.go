@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useFreshStats starts the test with empty statistics and warnings
+func useFreshStats(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		stats.Lock()
+		stats.Daily, stats.Mirrors = map[string]int64{}, map[string]*mirrorStats{}
+		stats.Unlock()
+		warningsMutex.Lock()
+		recentWarnings = nil
+		warningsMutex.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestSumPeriods(t *testing.T) {
+	// a Wednesday
+	now := time.Date(2024, 5, 15, 12, 0, 0, 0, time.Local)
+	totals := sumPeriods(map[string]int64{
+		"2024-05-15": 1,
+		"2024-05-13": 2,  // Monday, same week
+		"2024-05-12": 4,  // Sunday, last week
+		"2024-04-30": 8,  // last month
+		"2023-05-15": 16, // last year
+	}, now)
+	if totals != (periodTotals{Total: 31, Month: 7, Week: 3, Day: 1}) {
+		t.Errorf("unexpected totals %+v", totals)
+	}
+}
+
+func TestServerStatsAfterGrab(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	useFreshStats(t)
+	slot := proxy.waitForHistory(t, proxy.grab(t, findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Red Bar"}}), "Red Bar")))
+	if slot.Status != "Completed" {
+		t.Fatalf("download failed: %+v", slot)
+	}
+
+	var resp ServerStatsResponse
+	if err := json.Unmarshal([]byte(proxy.get(t, "/downloader/api", url.Values{"mode": {"server_stats"}})), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Day == 0 || resp.Day != resp.Total || resp.Week != resp.Total {
+		t.Errorf("today's download should be counted, got %+v", resp.periodTotals)
+	}
+	mirror, ok := resp.Servers[mirrorLabel(proxy.Upstream.URL)]
+	today := time.Now().Format(dayFormat)
+	if !ok || mirror.Day == 0 || mirror.ArticlesTried[today] == 0 || mirror.ArticlesSuccess[today] != mirror.ArticlesTried[today] {
+		t.Errorf("the mirror should show up as a server, got %+v", resp.Servers)
+	}
+}
+
+func TestStatsSurviveRestart(t *testing.T) {
+	newTestProxy(t, "flac")
+	useFreshStats(t)
+	countDownload(1234)
+	countMirrorRequest("https://mirror.example", 10, "")
+	if err := saveStats(); err != nil {
+		t.Fatal(err)
+	}
+	stats.Daily, stats.Mirrors = map[string]int64{}, map[string]*mirrorStats{}
+	loadStats()
+	if stats.Daily[time.Now().Format(dayFormat)] != 1234 || stats.Mirrors["mirror.example"] == nil {
+		t.Errorf("statistics weren't restored: %+v", stats.Daily)
+	}
+}
+
+func TestWarningsFromDamagedTracks(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	useFreshStats(t)
+	proxy.Upstream.Corrupt(1)
+	proxy.waitForHistory(t, proxy.grab(t, findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Red Bar"}}), "Red Bar")))
+
+	var resp WarningsResponse
+	if err := json.Unmarshal([]byte(proxy.get(t, "/downloader/api", url.Values{"mode": {"warnings"}})), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0].Text, "Flaky failed verification") || resp.Warnings[0].Type != "WARNING" {
+		t.Errorf("expected a warning about the damaged track, got %+v", resp.Warnings)
+	}
+
+	proxy.get(t, "/downloader/api", url.Values{"mode": {"warnings"}, "name": {"clear"}})
+	if warnings := listWarnings(); len(warnings) != 0 {
+		t.Errorf("warnings should be cleared, got %+v", warnings)
+	}
+}
+
+func TestWarningsKeepTheLatest(t *testing.T) {
+	useFreshStats(t)
+	for i := 0; i < maxWarnings+5; i++ {
+		addWarning("test", "warning")
+	}
+	if warnings := listWarnings(); len(warnings) != maxWarnings {
+		t.Errorf("expected %d warnings, got %d", maxWarnings, len(warnings))
+	}
+}
+
+func TestFullStatusAndCategories(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	useFreshStats(t)
+	addWarning("test", "something went wrong")
+
+	var resp FullStatusResponse
+	if err := json.Unmarshal([]byte(proxy.get(t, "/downloader/api", url.Values{"mode": {"fullstatus"}, "skip_dashboard": {"1"}})), &resp); err != nil {
+		t.Fatal(err)
+	}
+	status := resp.Status
+	if status.CompleteDir != filepath.Join(DownloadPath, "complete") || status.Version != sabVersion || status.Status != "Idle" {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if status.HaveWarnings != "1" || len(status.Servers) != 1 || status.Servers[0].ServerName != mirrorLabel(proxy.Upstream.URL) {
+		t.Errorf("expected the warning and the mirror, got %+v", status)
+	}
+
+	if body := proxy.get(t, "/downloader/api", url.Values{"mode": {"get_cats"}}); !strings.Contains(body, `"categories":["*","music"]`) {
+		t.Errorf("unexpected categories %s", body)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"image/jpeg"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.senan.xyz/taglib"
+)
+
+// outputFormat describes what a track is transcoded to after it's downloaded
+type outputFormat struct {
+	Name      string
+	Extension string
+	// ffmpeg arguments selecting the encoder
+	Codec []string
+	// average bitrate in kbps, used to estimate sizes. 0 for lossless
+	Bitrate  int
+	Lossless bool
+	// how the format shows up in release names, so Lidarr parses the right quality
+	Release string
+	// whether ffmpeg copies embedded cover art into the container. Ogg can't take it as a stream, so the cover
+	// is written as a Vorbis comment instead
+	Art bool
+}
+
+var outputFormats = map[string]outputFormat{
+	"opus":    {Name: "opus", Extension: ".opus", Codec: []string{"-c:a", "libopus", "-vbr", "on"}, Bitrate: 128, Release: "WEB-OPUS"},
+	"mp3-v0":  {Name: "mp3-v0", Extension: ".mp3", Codec: []string{"-c:a", "libmp3lame", "-q:a", "0", "-id3v2_version", "3"}, Bitrate: 245, Release: "WEB-MP3-V0", Art: true},
+	"mp3-320": {Name: "mp3-320", Extension: ".mp3", Codec: []string{"-c:a", "libmp3lame", "-b:a", "320k", "-id3v2_version", "3"}, Bitrate: 320, Release: "WEB-320-MP3", Art: true},
+	"alac":    {Name: "alac", Extension: ".m4a", Codec: []string{"-c:a", "alac"}, Lossless: true, Release: "WEB-ALAC", Art: true},
+}
+
+// Transcode is the configured output format, nil to keep what Tidal sends
+var Transcode *outputFormat
+
+// ArchiveDir keeps the original files when transcoding. Empty replaces them.
+var ArchiveDir string
+var FfmpegPath string
+
+const transcodeTimeout = 10 * time.Minute
+
+func setupTranscode() {
+	FfmpegPath = getEnv("FFMPEG", "ffmpeg")
+	ArchiveDir = getEnv("TRANSCODE_ARCHIVE_DIR", "")
+	name := strings.ToLower(getEnv("TRANSCODE", ""))
+	if name == "" || name == "none" {
+		return
+	}
+	format, ok := outputFormats[name]
+	if !ok {
+		exitWithError("Invalid TRANSCODE", fmt.Errorf("%q isn't one of opus, mp3-v0, mp3-320 or alac", name))
+	}
+	if format.Name == "opus" {
+		bitrate, err := strconv.Atoi(getEnv("OPUS_BITRATE", "128"))
+		if err != nil || bitrate < 6 || bitrate > 510 {
+			exitWithError("Invalid OPUS_BITRATE", fmt.Errorf("%q isn't a bitrate in kbit/s between 6 and 510", getEnv("OPUS_BITRATE", "128")))
+		}
+		format.Bitrate = bitrate
+		format.Codec = append(format.Codec, "-b:a", strconv.Itoa(bitrate)+"k")
+		format.Release += "-" + strconv.Itoa(bitrate)
+	}
+	if _, err := exec.LookPath(FfmpegPath); err != nil {
+		exitWithError("TRANSCODE is set but ffmpeg can't be found", err)
+	}
+	Transcode = &format
+}
+
+// outputExtension is the extension tracks end up with
+func outputExtension() string {
+	if Transcode != nil {
+		return Transcode.Extension
+	}
+	return FileExtension
+}
+
+// outputLossy reports whether the files handed to Lidarr are lossy, after transcoding
+func outputLossy() bool {
+	if Transcode != nil {
+		return !Transcode.Lossless
+	}
+	return QualityId == "HIGH"
+}
+
+// outputQuality names what the album folder holds, for its manifest
+func outputQuality() string {
+	if Transcode != nil {
+		return Transcode.Name
+	}
+	return QualityId
+}
+
+// ffmpegArgs builds the command line turning source into target, keeping tags and cover art
+func ffmpegArgs(format outputFormat, source string, target string) []string {
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", source, "-map", "0:a", "-map_metadata", "0"}
+	if format.Art {
+		args = append(args, "-map", "0:v?", "-c:v", "copy", "-disposition:v", "attached_pic")
+	} else {
+		args = append(args, "-vn")
+	}
+	args = append(args, format.Codec...)
+	return append(args, target)
+}
+
+// transcodeTrack converts a downloaded and tagged track to the configured format and returns the new file.
+// The source is moved to the archive folder or removed.
+func transcodeTrack(download Download, track File, source string) (string, error) {
+	if Transcode == nil {
+		return source, nil
+	}
+	target := strings.TrimSuffix(source, filepath.Ext(source)) + Transcode.Extension
+	// ffmpeg picks the muxer from the extension, so the temporary file keeps it
+	partial := strings.TrimSuffix(target, Transcode.Extension) + ".partial" + Transcode.Extension
+	ctx, cancel := context.WithTimeout(context.Background(), transcodeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, FfmpegPath, ffmpegArgs(*Transcode, source, partial)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(partial)
+		return "", fmt.Errorf("ffmpeg failed on %s: %w: %s", filepath.Base(source), err, strings.TrimSpace(stderr.String()))
+	}
+	// ffmpeg's tag mapping differs between containers, taglib writes the same tags everywhere
+	writeMetaData(download, track, partial)
+	if !Transcode.Art {
+		cover := filepath.Join(DownloadPath, "incomplete", Category, download.FileName, "cover.jpg")
+		if err := embedCover(partial, cover); err != nil {
+			slog.Warn("Couldn't embed the cover", "nzo_id", "SABnzbd_nzo_"+download.Id, "file", partial, "error", err)
+		}
+	}
+
+	if ArchiveDir != "" {
+		archive := filepath.Join(ArchiveDir, download.FileName, trackFileName(download, track)+filepath.Ext(source))
+		if err := os.MkdirAll(filepath.Dir(archive), 0755); err != nil {
+			return "", err
+		}
+		if err := moveFile(source, archive); err != nil {
+			return "", err
+		}
+	} else if source != target {
+		if err := os.Remove(source); err != nil {
+			return "", err
+		}
+	}
+	return target, os.Rename(partial, target)
+}
+
+// embedCover writes a JPEG as the front cover of an Ogg file, in a METADATA_BLOCK_PICTURE comment holding a FLAC
+// picture block
+func embedCover(path string, cover string) error {
+	image, err := os.ReadFile(cover)
+	if err != nil {
+		return err
+	}
+	//the size is only informative, a cover that doesn't parse is still embedded
+	config, _ := jpeg.DecodeConfig(bytes.NewReader(image))
+	block := binary.BigEndian.AppendUint32(nil, 3) // front cover
+	block = binary.BigEndian.AppendUint32(block, uint32(len("image/jpeg")))
+	block = append(block, "image/jpeg"...)
+	block = binary.BigEndian.AppendUint32(block, 0) // no description
+	block = binary.BigEndian.AppendUint32(block, uint32(config.Width))
+	block = binary.BigEndian.AppendUint32(block, uint32(config.Height))
+	block = binary.BigEndian.AppendUint32(block, 24)
+	block = binary.BigEndian.AppendUint32(block, 0)
+	block = binary.BigEndian.AppendUint32(block, uint32(len(image)))
+	block = append(block, image...)
+	return taglib.WriteTags(path, map[string][]string{"METADATA_BLOCK_PICTURE": {base64.StdEncoding.EncodeToString(block)}}, 0)
+}
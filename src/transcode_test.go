@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"go.senan.xyz/taglib"
+)
+
+// fakeFfmpeg installs a script standing in for ffmpeg that copies its input to its output and logs its arguments.
+// Opus output is a silent Ogg Opus stream instead, so taglib can tag it. Writing to "-" prints a loudness summary of
+// -12 LUFS and -1 dBFS, like the ebur128 filter.
+func fakeFfmpeg(t *testing.T) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake ffmpeg is a shell script")
+	}
+	dir := t.TempDir()
+	log := filepath.Join(dir, "args.log")
+	script := "#!/bin/sh\n" +
+		"echo \"$@\" >> " + log + "\n" +
+		"while [ $# -gt 1 ]; do\n" +
+		"  if [ \"$1\" = -i ]; then input=$2; fi\n" +
+		"  shift\n" +
+		"done\n" +
+		"if [ \"$1\" = - ]; then\n" +
+		"  printf '  Integrated loudness:\\n    I:         -12.0 LUFS\\n  True peak:\\n    Peak:       -1.0 dBFS\\n' >&2\n" +
+		"  exit 0\n" +
+		"fi\n" +
+		"case \"$1\" in\n" +
+		"  *.opus) cp " + filepath.Join(dir, "silence.opus") + " \"$1\" ;;\n" +
+		"  *) cp \"$input\" \"$1\" ;;\n" +
+		"esac\n"
+	if err := os.WriteFile(filepath.Join(dir, "silence.opus"), makeOpus(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "ffmpeg")
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return log
+}
+
+func useTranscode(t *testing.T, name string, archive string) string {
+	t.Helper()
+	log := fakeFfmpeg(t)
+	oldTranscode, oldArchive, oldFfmpeg := Transcode, ArchiveDir, FfmpegPath
+	t.Cleanup(func() {
+		Transcode, ArchiveDir, FfmpegPath = oldTranscode, oldArchive, oldFfmpeg
+	})
+	t.Setenv("TRANSCODE", name)
+	t.Setenv("TRANSCODE_ARCHIVE_DIR", archive)
+	t.Setenv("FFMPEG", filepath.Join(filepath.Dir(log), "ffmpeg"))
+	setupTranscode()
+	return log
+}
+
+func TestTranscodeReplacesSource(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	log := useTranscode(t, "mp3-v0", "")
+
+	item := findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Green Bar"}}), "Green Bar")
+	if item.Title != "The Testers-Green Bar-WEB-MP3-V0-2021-TIDLARR" {
+		t.Errorf("unexpected release name %q", item.Title)
+	}
+	// 2 seconds at V0's 245kbps average
+	if item.Category != "Audio > MP3" || attr(item, "size") != "61250" {
+		t.Errorf("unexpected category or size: %+v", item)
+	}
+
+	slot := proxy.waitForHistory(t, proxy.grab(t, item))
+	if slot.Status != "Completed" {
+		t.Fatalf("download failed: %+v", slot)
+	}
+	for _, name := range []string{"01 - The Testers - Setup", "02 - The Testers - Teardown"} {
+		if _, err := os.Stat(filepath.Join(slot.Storage, name+".mp3")); err != nil {
+			t.Errorf("transcoded track missing: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(slot.Storage, name+".flac")); !os.IsNotExist(err) {
+			t.Errorf("source should have been replaced: %v", err)
+		}
+	}
+	args, _ := os.ReadFile(log)
+	if !strings.Contains(string(args), "-c:a libmp3lame -q:a 0") || !strings.Contains(string(args), "attached_pic") {
+		t.Errorf("unexpected ffmpeg arguments %q", args)
+	}
+	manifest, err := readManifest(slot.Storage)
+	if err != nil || manifest.Quality != "mp3-v0" {
+		t.Errorf("manifest should record the output format: %+v %v", manifest, err)
+	}
+}
+
+func TestTranscodeKeepsSourceInArchive(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	archive := t.TempDir()
+	t.Setenv("OPUS_BITRATE", "96")
+	useTranscode(t, "opus", archive)
+
+	item := findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Red Bar"}}), "Red Bar")
+	if item.Title != "The Testers-Red Bar-WEB-OPUS-96-2019-TIDLARR" {
+		t.Errorf("unexpected release name %q", item.Title)
+	}
+	slot := proxy.waitForHistory(t, proxy.grab(t, item))
+	if slot.Status != "Completed" {
+		t.Fatalf("download failed: %+v", slot)
+	}
+	if _, err := os.Stat(filepath.Join(slot.Storage, "01 - The Testers - Flaky.opus")); err != nil {
+		t.Errorf("transcoded track missing: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(archive, item.Title, "01 - The Testers - Flaky.flac")); err != nil {
+		t.Errorf("source wasn't archived: %v", err)
+	}
+}
+
+func TestTranscodeToOpusEmbedsCover(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	log := useTranscode(t, "opus", "")
+	slot := proxy.waitForHistory(t, proxy.grab(t, findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Red Bar"}}), "Red Bar")))
+	if slot.Status != "Completed" {
+		t.Fatalf("download failed: %+v", slot)
+	}
+	if args, _ := os.ReadFile(log); !strings.Contains(string(args), "-vn") {
+		t.Errorf("ffmpeg can't put art in Ogg, expected -vn: %q", args)
+	}
+	path := filepath.Join(slot.Storage, "01 - The Testers - Flaky.opus")
+	if tags, err := taglib.ReadTags(path); err != nil || tags[taglib.Album][0] != "Red Bar" {
+		t.Errorf("tags lost next to the cover: %v %v", tags, err)
+	}
+	data, _ := os.ReadFile(path)
+	start := bytes.Index(data, []byte("METADATA_BLOCK_PICTURE="))
+	if start < 0 {
+		t.Fatal("no cover in the opus file")
+	}
+	start += len("METADATA_BLOCK_PICTURE=")
+	end := start
+	for end < len(data) && bytes.IndexByte([]byte("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/="), data[end]) >= 0 {
+		end++
+	}
+	block, err := base64.StdEncoding.DecodeString(string(data[start:end]))
+	cover, _ := os.ReadFile(filepath.Join(slot.Storage, "cover.jpg"))
+	if err != nil || len(cover) == 0 || !bytes.HasSuffix(block, cover) || !bytes.Contains(block, []byte("image/jpeg")) {
+		t.Errorf("the embedded picture isn't the cover: %v %x", err, block)
+	}
+}
+
+func TestTranscodeLosslessKeepsLosslessCategory(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	useTranscode(t, "alac", "")
+	item := findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Green Bar"}}), "Green Bar")
+	if item.Title != "The Testers-Green Bar-16BIT-44-KHZ-WEB-ALAC-2021-TIDLARR" || item.Category != "Audio > Lossless" {
+		t.Errorf("unexpected release %q in %q", item.Title, item.Category)
+	}
+}
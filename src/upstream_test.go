@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeTrack struct {
+	Id           int
+	Title        string
+	TrackNumber  int
+	VolumeNumber int
+	Isrc         string
+	Duration     int
+}
+
+type fakeAlbum struct {
+	Id     string
+	Artist string
+	// Tidal's ID for the artist, 500 unless set
+	ArtistId    string
+	Title       string
+	Version     string
+	ReleaseDate string
+	Copyright   string
+	Cover       string
+	Explicit    bool
+	Tracks      []fakeTrack
+	// left out of album searches, like everything past upstream's first 25 results
+	Unlisted bool
+	// an EP or single, which discographies list apart from albums
+	Single bool
+}
+
+func (album fakeAlbum) artistId() string {
+	if album.ArtistId == "" {
+		return "500"
+	}
+	return album.ArtistId
+}
+
+// listing is the album as searches and discographies list it
+func (album fakeAlbum) listing() map[string]any {
+	return map[string]any{
+		"id":             json.Number(album.Id),
+		"title":          album.Title,
+		"version":        album.Version,
+		"releaseDate":    album.ReleaseDate,
+		"copyright":      album.Copyright,
+		"numberOfTracks": len(album.Tracks),
+		"duration":       album.duration(),
+		"explicit":       album.Explicit,
+		"cover":          album.Cover,
+		"artists":        []map[string]any{{"id": json.Number(album.artistId()), "name": album.Artist}},
+	}
+}
+
+func (album fakeAlbum) duration() (duration int) {
+	for _, track := range album.Tracks {
+		duration += track.Duration
+	}
+	return duration
+}
+
+// fakeUpstream imitates a hifi-API mirror: search, album and track endpoints, plus the media and
+// cover files the manifests point to.
+type fakeUpstream struct {
+	*httptest.Server
+	Albums []fakeAlbum
+	Flac   []byte
+	M4a    []byte
+
+	mu   sync.Mutex
+	hits map[string]int
+	// the next throttled requests are answered with 429 and a one second Retry-After
+	throttled int
+	// the next corrupted media requests are answered with a truncated file
+	corrupted int
+	// requests for stalled paths block until the channel is closed
+	stalled map[string]chan struct{}
+}
+
+func newFakeUpstream(t *testing.T, albums ...fakeAlbum) *fakeUpstream {
+	t.Helper()
+	upstream := &fakeUpstream{
+		Albums:  albums,
+		Flac:    makeFlac(1, 440),
+		M4a:     makeM4a(1),
+		hits:    map[string]int{},
+		stalled: map[string]chan struct{}{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search/", upstream.search)
+	mux.HandleFunc("/artist/", upstream.artist)
+	mux.HandleFunc("/album", upstream.album)
+	mux.HandleFunc("/album/", upstream.album)
+	mux.HandleFunc("/track/", upstream.track)
+	mux.HandleFunc("/media/", upstream.media)
+	mux.HandleFunc("/images/", upstream.image)
+	upstream.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.mu.Lock()
+		upstream.hits[r.URL.Path]++
+		throttle := upstream.throttled > 0
+		if throttle {
+			upstream.throttled--
+		}
+		stall := upstream.stalled[r.URL.Path]
+		upstream.mu.Unlock()
+		if stall != nil {
+			<-stall
+		}
+		if throttle {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// Hits returns how often a path was requested
+func (f *fakeUpstream) Hits(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.hits[path]
+}
+
+// Throttle makes the next n requests fail with 429 Too Many Requests
+func (f *fakeUpstream) Throttle(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.throttled = n
+}
+
+// Corrupt cuts the next n media files in half, like a connection dropped mid-transfer
+func (f *fakeUpstream) Corrupt(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.corrupted = n
+}
+
+// Stall holds every request for path until the returned function is called
+func (f *fakeUpstream) Stall(path string) (release func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stall := make(chan struct{})
+	f.stalled[path] = stall
+	return func() {
+		f.mu.Lock()
+		delete(f.stalled, path)
+		f.mu.Unlock()
+		close(stall)
+	}
+}
+
+func (f *fakeUpstream) find(id string) (fakeAlbum, bool) {
+	for _, album := range f.Albums {
+		if album.Id == id {
+			return album, true
+		}
+	}
+	return fakeAlbum{}, false
+}
+
+func writeJson(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func (f *fakeUpstream) search(w http.ResponseWriter, r *http.Request) {
+	if artist := r.URL.Query().Get("a"); artist != "" {
+		f.searchArtists(w, artist)
+		return
+	}
+	words := strings.Fields(strings.ToLower(r.URL.Query().Get("al")))
+	items := []map[string]any{}
+	for _, album := range f.Albums {
+		haystack := strings.ToLower(album.Artist + " " + album.Title)
+		matches := true
+		for _, word := range words {
+			if !strings.Contains(haystack, word) {
+				matches = false
+			}
+		}
+		if !matches || album.Unlisted {
+			continue
+		}
+		items = append(items, album.listing())
+	}
+	writeJson(w, map[string]any{
+		"version": "2.0",
+		"data": map[string]any{
+			"albums": map[string]any{"limit": 25, "offset": 0, "totalNumberOfItems": len(items), "items": items},
+		},
+	})
+}
+
+func (f *fakeUpstream) searchArtists(w http.ResponseWriter, name string) {
+	items := []map[string]any{}
+	seen := map[string]bool{}
+	for _, album := range f.Albums {
+		matches := true
+		for _, word := range strings.Fields(strings.ToLower(name)) {
+			if !strings.Contains(strings.ToLower(album.Artist), word) {
+				matches = false
+			}
+		}
+		if matches && !seen[album.artistId()] {
+			seen[album.artistId()] = true
+			items = append(items, map[string]any{"id": json.Number(album.artistId()), "name": album.Artist})
+		}
+	}
+	writeJson(w, map[string]any{
+		"version": "2.0",
+		"data": map[string]any{
+			"artists": map[string]any{"limit": 25, "offset": 0, "totalNumberOfItems": len(items), "items": items},
+		},
+	})
+}
+
+// artist answers ?f= with a page of the artist's albums, or of their EPs and singles
+func (f *fakeUpstream) artist(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	items := []map[string]any{}
+	for _, album := range f.Albums {
+		if album.artistId() == query.Get("f") && album.Single == (query.Get("filter") == "EPSANDSINGLES") {
+			items = append(items, album.listing())
+		}
+	}
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil {
+		limit = 10
+	}
+	page := items[min(offset, len(items)):min(offset+limit, len(items))]
+	writeJson(w, map[string]any{
+		"version": "2.0",
+		"albums":  map[string]any{"limit": limit, "offset": offset, "totalNumberOfItems": len(items), "items": page},
+		"tracks":  []any{},
+	})
+}
+
+func (f *fakeUpstream) album(w http.ResponseWriter, r *http.Request) {
+	album, ok := f.find(r.URL.Query().Get("id"))
+	if !ok {
+		http.Error(w, `{"detail":"Album not found"}`, http.StatusNotFound)
+		return
+	}
+	items := []map[string]any{}
+	for _, track := range album.Tracks {
+		items = append(items, map[string]any{
+			"type": "track",
+			"item": map[string]any{
+				"id":           track.Id,
+				"title":        track.Title,
+				"trackNumber":  track.TrackNumber,
+				"volumeNumber": track.VolumeNumber,
+				"isrc":         track.Isrc,
+				"duration":     track.Duration,
+				"copyright":    album.Copyright,
+				"explicit":     album.Explicit,
+				"replayGain":   -7.5,
+				"peak":         0.98,
+				"artist":       map[string]any{"name": album.Artist},
+				"album":        map[string]any{"id": json.Number(album.Id), "title": album.Title, "cover": album.Cover},
+			},
+		})
+	}
+	writeJson(w, map[string]any{
+		"version": "2.0",
+		"data": map[string]any{
+			"id":             json.Number(album.Id),
+			"title":          album.Title,
+			"releaseDate":    album.ReleaseDate,
+			"numberOfTracks": len(album.Tracks),
+			"items":          items,
+		},
+	})
+}
+
+func (f *fakeUpstream) track(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	quality := r.URL.Query().Get("quality")
+	manifest := map[string]any{"mimeType": "audio/flac", "codecs": "flac", "encryptionType": "NONE", "urls": []string{f.URL + "/media/" + id + ".flac"}}
+	if quality == "HIGH" {
+		manifest = map[string]any{"mimeType": "audio/mp4", "codecs": "mp4a.40.2", "encryptionType": "NONE", "urls": []string{f.URL + "/media/" + id + ".m4a"}}
+	}
+	encoded, _ := json.Marshal(manifest)
+	trackId, _ := strconv.Atoi(id)
+	writeJson(w, map[string]any{
+		"version": "2.0",
+		"data": map[string]any{
+			"trackId":              trackId,
+			"audioQuality":         quality,
+			"manifestMimeType":     "application/vnd.tidal.bts",
+			"manifest":             base64.StdEncoding.EncodeToString(encoded),
+			"albumReplayGain":      -8.1,
+			"albumPeakAmplitude":   0.99,
+			"trackReplayGain":      -7.5,
+			"trackPeakAmplitude":   0.98,
+			"bitDepth":             16,
+			"sampleRate":           44100,
+			"assetPresentation":    "FULL",
+			"audioMode":            "STEREO",
+			"manifestHash":         "fake",
+			"previewReason":        nil,
+			"streamingSessionId":   "fake",
+			"licenseSecurityToken": nil,
+		},
+	})
+}
+
+func (f *fakeUpstream) media(w http.ResponseWriter, r *http.Request) {
+	data, kind := f.Flac, "audio/flac"
+	if strings.HasSuffix(r.URL.Path, ".m4a") {
+		data, kind = f.M4a, "audio/mp4"
+	}
+	f.mu.Lock()
+	if f.corrupted > 0 {
+		f.corrupted--
+		data = data[:len(data)/2]
+	}
+	f.mu.Unlock()
+	w.Header().Set("Content-Type", kind)
+	w.Write(data)
+}
+
+func (f *fakeUpstream) image(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Write([]byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x10, 'J', 'F', 'I', 'F', 0x00, 0xFF, 0xD9})
+}
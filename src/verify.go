@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every track is checked before it's tagged: a truncated file or an error page saved as a track would otherwise be
+// imported by Lidarr as a corrupt file. FLAC is fully decoded and compared to its STREAMINFO MD5, M4A only gets its
+// box structure checked. Both have their length compared to the duration Tidal reports.
+
+// how often a track failing verification is downloaded again before the job fails
+var VerifyRetries int = 2
+var DurationTolerance = 2 * time.Second
+
+func setupVerify() {
+	var err error
+	VerifyRetries, err = strconv.Atoi(getEnv("VERIFY_RETRIES", "2"))
+	if err != nil || VerifyRetries < 0 {
+		exitWithError("Invalid VERIFY_RETRIES", fmt.Errorf("%q isn't a number of retries", getEnv("VERIFY_RETRIES", "2")))
+	}
+	DurationTolerance, err = time.ParseDuration(getEnv("VERIFY_DURATION_TOLERANCE", "2s"))
+	if err != nil {
+		exitWithError("Invalid VERIFY_DURATION_TOLERANCE", err)
+	}
+}
+
+// verifyTrack checks a downloaded track. expected is Tidal's duration, in seconds, 0 if unknown.
+func verifyTrack(path string, expected int) error {
+	var duration time.Duration
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".flac":
+		duration, err = verifyFlac(path)
+	case ".m4a", ".mp4":
+		duration, err = verifyM4a(path)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if expected > 0 && duration > 0 {
+		difference := duration - time.Duration(expected)*time.Second
+		if difference < -DurationTolerance || difference > DurationTolerance {
+			return fmt.Errorf("track is %s long, expected %ds", duration.Round(time.Millisecond), expected)
+		}
+	}
+	return nil
+}
+
+// bitReader reads the big-endian bit fields FLAC frames are made of
+type bitReader struct {
+	r     *bufio.Reader
+	cache uint64
+	n     uint
+}
+
+func (b *bitReader) read(bits uint) (uint64, error) {
+	for b.n < bits {
+		c, err := b.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		b.cache = b.cache<<8 | uint64(c)
+		b.n += 8
+	}
+	b.n -= bits
+	return (b.cache >> b.n) & (1<<bits - 1), nil
+}
+
+func (b *bitReader) readSigned(bits uint) (int64, error) {
+	value, err := b.read(bits)
+	if err != nil || bits == 0 {
+		return 0, err
+	}
+	return int64(value<<(64-bits)) >> (64 - bits), nil
+}
+
+// readUnary counts the zero bits before the next one
+func (b *bitReader) readUnary() (uint64, error) {
+	var count uint64
+	for {
+		bit, err := b.read(1)
+		if err != nil {
+			return 0, err
+		}
+		if bit == 1 {
+			return count, nil
+		}
+		count++
+	}
+}
+
+func (b *bitReader) align() {
+	b.n -= b.n % 8
+}
+
+type flacStreamInfo struct {
+	sampleRate    int
+	channels      int
+	bitsPerSample int
+	totalSamples  uint64
+	md5           [16]byte
+}
+
+// verifyFlac decodes the whole file and compares the decoded audio to the MD5 in its STREAMINFO
+func verifyFlac(path string) (time.Duration, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	r := bufio.NewReaderSize(file, 1<<16)
+
+	info, err := readFlacMetadata(r)
+	if err != nil {
+		return 0, err
+	}
+	if info.sampleRate == 0 || info.channels == 0 {
+		return 0, errors.New("FLAC STREAMINFO is invalid")
+	}
+	duration := time.Duration(info.totalSamples) * time.Second / time.Duration(info.sampleRate)
+
+	sum := md5.New()
+	reader := &bitReader{r: r}
+	bytesPerSample := (info.bitsPerSample + 7) / 8
+	out := make([]byte, 0, 1<<16)
+	var decoded uint64
+	for info.totalSamples == 0 || decoded < info.totalSamples {
+		if _, err := r.Peek(1); err == io.EOF && info.totalSamples == 0 {
+			break
+		}
+		samples, err := decodeFlacFrame(reader, info)
+		if err != nil {
+			return 0, fmt.Errorf("FLAC is damaged after %d of %d samples: %w", decoded, info.totalSamples, err)
+		}
+		out = out[:0]
+		for i := range samples[0] {
+			for channel := range samples {
+				sample := uint32(samples[channel][i])
+				for b := 0; b < bytesPerSample; b++ {
+					out = append(out, byte(sample>>(8*b)))
+				}
+			}
+		}
+		sum.Write(out)
+		decoded += uint64(len(samples[0]))
+	}
+	if info.md5 != [16]byte{} && !bytes.Equal(sum.Sum(nil), info.md5[:]) {
+		return 0, errors.New("FLAC audio doesn't match its MD5 signature")
+	}
+	return duration, nil
+}
+
+func readFlacMetadata(r *bufio.Reader) (flacStreamInfo, error) {
+	var info flacStreamInfo
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return info, fmt.Errorf("not a FLAC file: %w", err)
+	}
+	if string(magic[:3]) == "ID3" {
+		//skip an ID3v2 tag in front of the stream: the rest of its 10 byte header, the tag, and a footer if flagged
+		header := make([]byte, 6)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return info, err
+		}
+		size := int(header[2])<<21 | int(header[3])<<14 | int(header[4])<<7 | int(header[5])
+		if header[1]&0x10 != 0 {
+			size += 10
+		}
+		if _, err := r.Discard(size); err != nil {
+			return info, err
+		}
+		if _, err := io.ReadFull(r, magic); err != nil {
+			return info, err
+		}
+	}
+	if string(magic) != "fLaC" {
+		return info, fmt.Errorf("not a FLAC file, starts with %q", magic)
+	}
+	for last, first := false, true; !last; first = false {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return info, fmt.Errorf("FLAC metadata is truncated: %w", err)
+		}
+		last = header[0]&0x80 != 0
+		kind := header[0] & 0x7F
+		length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		block := make([]byte, length)
+		if _, err := io.ReadFull(r, block); err != nil {
+			return info, fmt.Errorf("FLAC metadata is truncated: %w", err)
+		}
+		if first && (kind != 0 || length < 34) {
+			return info, errors.New("FLAC doesn't start with a STREAMINFO block")
+		}
+		if !first && kind == 0 {
+			return info, errors.New("FLAC has a second STREAMINFO block")
+		}
+		if kind == 0 {
+			packed := binary.BigEndian.Uint64(block[10:18])
+			info.sampleRate = int(packed >> 44)
+			info.channels = int(packed>>41&0x7) + 1
+			info.bitsPerSample = int(packed>>36&0x1F) + 1
+			info.totalSamples = packed & (1<<36 - 1)
+			copy(info.md5[:], block[18:34])
+		}
+	}
+	return info, nil
+}
+
+// decodeFlacFrame decodes the next frame into one slice of samples per channel
+func decodeFlacFrame(b *bitReader, info flacStreamInfo) ([][]int32, error) {
+	sync, err := b.read(15)
+	if err != nil {
+		return nil, err
+	}
+	if sync != 0x7FFC {
+		return nil, errors.New("lost frame sync")
+	}
+	b.read(1) // blocking strategy
+	blockCode, _ := b.read(4)
+	rateCode, _ := b.read(4)
+	assignment, _ := b.read(4)
+	sizeCode, _ := b.read(3)
+	if _, err := b.read(1); err != nil {
+		return nil, err
+	}
+	//frame or sample number, UTF-8 style coded
+	first, err := b.read(8)
+	if err != nil {
+		return nil, err
+	}
+	for mask := uint64(0x80); first&mask != 0 && mask > 1; mask >>= 1 {
+		if mask != 0x80 {
+			b.read(8)
+		}
+	}
+
+	var blockSize int
+	switch {
+	case blockCode == 1:
+		blockSize = 192
+	case blockCode >= 2 && blockCode <= 5:
+		blockSize = 576 << (blockCode - 2)
+	case blockCode == 6:
+		value, err := b.read(8)
+		if err != nil {
+			return nil, err
+		}
+		blockSize = int(value) + 1
+	case blockCode == 7:
+		value, err := b.read(16)
+		if err != nil {
+			return nil, err
+		}
+		blockSize = int(value) + 1
+	case blockCode >= 8:
+		blockSize = 256 << (blockCode - 8)
+	default:
+		return nil, errors.New("reserved block size")
+	}
+	switch rateCode {
+	case 12:
+		b.read(8)
+	case 13, 14:
+		b.read(16)
+	case 15:
+		return nil, errors.New("invalid sample rate")
+	}
+	bitsPerSample := info.bitsPerSample
+	if sizeCode != 0 {
+		sizes := map[uint64]int{1: 8, 2: 12, 4: 16, 5: 20, 6: 24, 7: 32}
+		var ok bool
+		if bitsPerSample, ok = sizes[sizeCode]; !ok {
+			return nil, errors.New("reserved sample size")
+		}
+	}
+	if _, err := b.read(8); err != nil { // header CRC, the MD5 catches what it would
+		return nil, err
+	}
+
+	channels := int(assignment) + 1
+	if assignment >= 8 && assignment <= 10 {
+		channels = 2
+	} else if assignment > 10 {
+		return nil, errors.New("reserved channel assignment")
+	}
+	samples := make([][]int32, channels)
+	for channel := range samples {
+		bits := bitsPerSample
+		//the side channel needs an extra bit
+		if (assignment == 8 || assignment == 10) && channel == 1 || assignment == 9 && channel == 0 {
+			bits++
+		}
+		samples[channel], err = decodeSubframe(b, blockSize, bits)
+		if err != nil {
+			return nil, err
+		}
+	}
+	b.align()
+	if _, err := b.read(16); err != nil { // frame CRC
+		return nil, err
+	}
+
+	left, right := samples[0], samples[len(samples)-1]
+	for i := 0; i < blockSize && channels == 2; i++ {
+		switch assignment {
+		case 8: // left/side
+			right[i] = left[i] - right[i]
+		case 9: // side/right
+			left[i] += right[i]
+		case 10: // mid/side
+			mid := int64(left[i])<<1 | int64(right[i])&1
+			side := int64(right[i])
+			left[i] = int32((mid + side) >> 1)
+			right[i] = int32((mid - side) >> 1)
+		}
+	}
+	return samples, nil
+}
+
+var fixedCoefficients = [][]int64{{}, {1}, {2, -1}, {3, -3, 1}, {4, -6, 4, -1}}
+
+func decodeSubframe(b *bitReader, blockSize int, bits int) ([]int32, error) {
+	header, err := b.read(8)
+	if err != nil {
+		return nil, err
+	}
+	if header&0x80 != 0 {
+		return nil, errors.New("invalid subframe header")
+	}
+	kind := header >> 1 & 0x3F
+	wasted := 0
+	if header&1 != 0 {
+		count, err := b.readUnary()
+		if err != nil {
+			return nil, err
+		}
+		wasted = int(count) + 1
+		bits -= wasted
+	}
+	samples := make([]int32, blockSize)
+	switch {
+	case kind == 0: // constant
+		value, err := b.readSigned(uint(bits))
+		if err != nil {
+			return nil, err
+		}
+		for i := range samples {
+			samples[i] = int32(value)
+		}
+	case kind == 1: // verbatim
+		for i := range samples {
+			value, err := b.readSigned(uint(bits))
+			if err != nil {
+				return nil, err
+			}
+			samples[i] = int32(value)
+		}
+	case kind >= 8 && kind <= 12: // fixed predictor
+		order := int(kind - 8)
+		if err := decodePredicted(b, samples, bits, fixedCoefficients[order], 0); err != nil {
+			return nil, err
+		}
+	case kind >= 32: // linear predictor
+		order := int(kind-32) + 1
+		if order > blockSize {
+			return nil, errors.New("predictor order larger than the block")
+		}
+		warmup := make([]int64, order)
+		for i := range warmup {
+			if warmup[i], err = b.readSigned(uint(bits)); err != nil {
+				return nil, err
+			}
+		}
+		precision, err := b.read(4)
+		if err != nil || precision == 15 {
+			return nil, errors.New("invalid LPC precision")
+		}
+		shift, err := b.readSigned(5)
+		if err != nil || shift < 0 {
+			return nil, errors.New("invalid LPC shift")
+		}
+		coefficients := make([]int64, order)
+		for i := range coefficients {
+			if coefficients[i], err = b.readSigned(uint(precision + 1)); err != nil {
+				return nil, err
+			}
+		}
+		for i, value := range warmup {
+			samples[i] = int32(value)
+		}
+		if err := decodePredicted(b, samples, -1, coefficients, uint(shift)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("reserved subframe type")
+	}
+	if wasted > 0 {
+		for i := range samples {
+			samples[i] <<= wasted
+		}
+	}
+	return samples, nil
+}
+
+// decodePredicted reads the residual and rebuilds the signal from it. Warm-up samples are read first unless bits is
+// -1, in which case they're already in samples.
+func decodePredicted(b *bitReader, samples []int32, bits int, coefficients []int64, shift uint) error {
+	order := len(coefficients)
+	if order > len(samples) {
+		return errors.New("predictor order larger than the block")
+	}
+	if bits >= 0 {
+		for i := 0; i < order; i++ {
+			value, err := b.readSigned(uint(bits))
+			if err != nil {
+				return err
+			}
+			samples[i] = int32(value)
+		}
+	}
+	if err := decodeResidual(b, samples, order); err != nil {
+		return err
+	}
+	for i := order; i < len(samples); i++ {
+		var prediction int64
+		for j, coefficient := range coefficients {
+			prediction += coefficient * int64(samples[i-j-1])
+		}
+		samples[i] += int32(prediction >> shift)
+	}
+	return nil
+}
+
+// decodeResidual reads the Rice coded residual into samples[order:]
+func decodeResidual(b *bitReader, samples []int32, order int) error {
+	method, err := b.read(2)
+	if err != nil {
+		return err
+	}
+	if method > 1 {
+		return errors.New("reserved residual coding method")
+	}
+	parameterBits, escape := uint(4), uint64(15)
+	if method == 1 {
+		parameterBits, escape = 5, 31
+	}
+	partitionOrder, err := b.read(4)
+	if err != nil {
+		return err
+	}
+	partitions := 1 << partitionOrder
+	if len(samples)%partitions != 0 || len(samples)/partitions < order {
+		return errors.New("invalid residual partitions")
+	}
+	i := order
+	for partition := 0; partition < partitions; partition++ {
+		count := len(samples) / partitions
+		if partition == 0 {
+			count -= order
+		}
+		parameter, err := b.read(parameterBits)
+		if err != nil {
+			return err
+		}
+		if parameter == escape {
+			raw, err := b.read(5)
+			if err != nil {
+				return err
+			}
+			for end := i + count; i < end; i++ {
+				value, err := b.readSigned(uint(raw))
+				if err != nil {
+					return err
+				}
+				samples[i] = int32(value)
+			}
+			continue
+		}
+		for end := i + count; i < end; i++ {
+			quotient, err := b.readUnary()
+			if err != nil {
+				return err
+			}
+			remainder, err := b.read(uint(parameter))
+			if err != nil {
+				return err
+			}
+			value := quotient<<parameter | remainder
+			samples[i] = int32(value>>1) ^ -int32(value&1)
+		}
+	}
+	return nil
+}
+
+// verifyM4a walks the top level boxes of an MP4 file, which have to cover it exactly, and reads its duration
+func verifyM4a(path string) (time.Duration, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	var duration time.Duration
+	found := map[string]bool{}
+	for offset := int64(0); offset < stat.Size(); {
+		header := make([]byte, 16)
+		if _, err := file.ReadAt(header[:8], offset); err != nil {
+			return 0, fmt.Errorf("MP4 box at %d is truncated: %w", offset, err)
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		kind := string(header[4:8])
+		headerSize := int64(8)
+		if size == 1 {
+			if _, err := file.ReadAt(header[8:16], offset+8); err != nil {
+				return 0, fmt.Errorf("MP4 box at %d is truncated: %w", offset, err)
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		} else if size == 0 {
+			size = stat.Size() - offset
+		}
+		if offset == 0 && kind != "ftyp" {
+			return 0, fmt.Errorf("not an MP4 file, starts with %q", header[:8])
+		}
+		if size < headerSize {
+			return 0, fmt.Errorf("invalid MP4 box %q at %d", kind, offset)
+		}
+		if offset+size > stat.Size() {
+			return 0, fmt.Errorf("MP4 is truncated, %q box needs %d bytes but only %d are left", kind, size, stat.Size()-offset)
+		}
+		found[kind] = true
+		if kind == "moov" {
+			moov := make([]byte, size-headerSize)
+			if _, err := file.ReadAt(moov, offset+headerSize); err != nil {
+				return 0, err
+			}
+			duration = mp4Duration(moov)
+		}
+		offset += size
+	}
+	if !found["moov"] || !found["mdat"] {
+		return 0, errors.New("MP4 is missing its moov or mdat box")
+	}
+	return duration, nil
+}
+
+// mp4Duration reads the duration from the movie header, or from the fragment header of a fragmented file
+func mp4Duration(moov []byte) time.Duration {
+	var duration time.Duration
+	for offset := 0; offset+8 <= len(moov); {
+		size := int(binary.BigEndian.Uint32(moov[offset:]))
+		if size < 8 || offset+size > len(moov) {
+			break
+		}
+		box := moov[offset+8 : offset+size]
+		switch string(moov[offset+4 : offset+8]) {
+		case "mvhd":
+			var timescale, length uint64
+			if len(box) >= 32 && box[0] == 1 {
+				timescale = uint64(binary.BigEndian.Uint32(box[20:]))
+				length = binary.BigEndian.Uint64(box[24:])
+			} else if len(box) >= 20 {
+				timescale = uint64(binary.BigEndian.Uint32(box[12:]))
+				length = uint64(binary.BigEndian.Uint32(box[16:]))
+			}
+			if timescale > 0 && length > 0 {
+				return time.Duration(length) * time.Second / time.Duration(timescale)
+			}
+		case "mvex":
+			//fragmented files leave mvhd empty, but the fragment duration uses the same timescale, read it again
+			duration = mp4FragmentDuration(box, moov)
+		}
+		offset += size
+	}
+	return duration
+}
+
+func mp4FragmentDuration(mvex []byte, moov []byte) time.Duration {
+	var timescale uint64
+	if index := bytes.Index(moov, []byte("mvhd")); index >= 0 && index+4+20 <= len(moov) {
+		header := moov[index+4:]
+		if header[0] == 1 && len(header) >= 24 {
+			timescale = uint64(binary.BigEndian.Uint32(header[20:]))
+		} else {
+			timescale = uint64(binary.BigEndian.Uint32(header[12:]))
+		}
+	}
+	index := bytes.Index(mvex, []byte("mehd"))
+	if timescale == 0 || index < 0 || index+4+8 > len(mvex) {
+		return 0
+	}
+	header := mvex[index+4:]
+	var length uint64
+	if header[0] == 1 && len(header) >= 12 {
+		length = binary.BigEndian.Uint64(header[4:])
+	} else {
+		length = uint64(binary.BigEndian.Uint32(header[4:]))
+	}
+	return time.Duration(length) * time.Second / time.Duration(timescale)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTemp(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerifyFlac(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"verbatim":   makeFlac(1, 440),
+		"compressed": makeCompressedFlac(1.5, 220),
+	} {
+		if err := verifyTrack(writeTemp(t, "track.flac", data), 1); err != nil {
+			t.Errorf("%s: intact FLAC failed verification: %v", name, err)
+		}
+	}
+}
+
+func TestVerifyFlacRejectsDamage(t *testing.T) {
+	good := makeCompressedFlac(1, 440)
+	flipped := append([]byte{}, good...)
+	flipped[len(flipped)/2] ^= 0x10
+	for name, data := range map[string][]byte{
+		"truncated":         good[:len(good)*2/3],
+		"bit flip":          flipped,
+		"error page":        []byte("<html><body>502 Bad Gateway</body></html>"),
+		"empty":             {},
+		"second streaminfo": secondStreamInfo(good),
+	} {
+		if err := verifyTrack(writeTemp(t, "track.flac", data), 1); err == nil {
+			t.Errorf("%s: damaged FLAC passed verification", name)
+		}
+	}
+}
+
+// secondStreamInfo puts a truncated STREAMINFO block after the real one
+func secondStreamInfo(flac []byte) []byte {
+	out := append([]byte{}, flac[:42]...)
+	out[4] &^= 0x80 // the first block is no longer the last
+	out = append(out, 0x80, 0, 0, 4, 0, 0, 0, 0)
+	return append(out, flac[42:]...)
+}
+
+func TestVerifyDuration(t *testing.T) {
+	path := writeTemp(t, "track.flac", makeFlac(1, 440))
+	if err := verifyTrack(path, 240); err == nil || !strings.Contains(err.Error(), "expected 240s") {
+		t.Errorf("a track much shorter than Tidal's duration should fail, got %v", err)
+	}
+	if err := verifyTrack(path, 0); err != nil {
+		t.Errorf("unknown duration shouldn't fail: %v", err)
+	}
+}
+
+func TestVerifyM4a(t *testing.T) {
+	good := makeM4a(3)
+	if err := verifyTrack(writeTemp(t, "track.m4a", good), 3); err != nil {
+		t.Errorf("intact M4A failed verification: %v", err)
+	}
+	if err := verifyTrack(writeTemp(t, "track.m4a", good), 60); err == nil {
+		t.Error("M4A duration wasn't checked")
+	}
+	if err := verifyTrack(writeTemp(t, "track.m4a", good[:len(good)-100]), 3); err == nil {
+		t.Error("truncated M4A passed verification")
+	}
+	if err := verifyTrack(writeTemp(t, "track.m4a", []byte("<html>not found</html>")), 3); err == nil {
+		t.Error("error page passed verification")
+	}
+}
+
+func TestDamagedTrackIsDownloadedAgain(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	proxy.Upstream.Corrupt(1)
+	item := findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Red Bar"}}), "Red Bar")
+	slot := proxy.waitForHistory(t, proxy.grab(t, item))
+	if slot.Status != "Completed" {
+		t.Fatalf("download failed: %+v", slot)
+	}
+	if hits := proxy.Upstream.Hits("/media/21.flac"); hits != 2 {
+		t.Errorf("expected the damaged track to be downloaded twice, got %d", hits)
+	}
+	if err := verifyTrack(filepath.Join(slot.Storage, "01 - The Testers - Flaky.flac"), 1); err != nil {
+		t.Errorf("completed track is damaged: %v", err)
+	}
+}
+
+func TestPersistentlyDamagedTrackFailsJob(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	proxy.Upstream.Corrupt(100)
+	item := findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Red Bar"}}), "Red Bar")
+	slot := proxy.waitForHistory(t, proxy.grab(t, item))
+	if slot.Status != "Failed" || !strings.Contains(slot.FailMessage, "failed verification") {
+		t.Fatalf("expected the job to fail verification, got %+v", slot)
+	}
+	if hits := proxy.Upstream.Hits("/media/21.flac"); hits != VerifyRetries+1 {
+		t.Errorf("expected %d attempts, got %d", VerifyRetries+1, hits)
+	}
+}
+
+// id3Tag is an ID3v2.4 tag holding padding only, with a footer if asked
+func id3Tag(size int, footer bool) []byte {
+	flags := byte(0)
+	if footer {
+		flags = 0x10
+	}
+	syncsafe := []byte{byte(size >> 21 & 0x7F), byte(size >> 14 & 0x7F), byte(size >> 7 & 0x7F), byte(size & 0x7F)}
+	tag := append([]byte{'I', 'D', '3', 4, 0, flags}, syncsafe...)
+	tag = append(tag, make([]byte, size)...)
+	if footer {
+		tag = append(tag, append([]byte{'3', 'D', 'I', 4, 0, flags}, syncsafe...)...)
+	}
+	return tag
+}
+
+func TestVerifyFlacAfterId3Tag(t *testing.T) {
+	for name, tag := range map[string][]byte{
+		"tag":        id3Tag(300, false),
+		"tag+footer": id3Tag(1000, true),
+	} {
+		data := append(tag, makeFlac(1, 440)...)
+		if err := verifyTrack(writeTemp(t, "track.flac", data), 1); err != nil {
+			t.Errorf("%s: FLAC behind an ID3 tag failed verification: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Instead of waiting for Lidarr to search, WANTED_SYNC_INTERVAL reads Lidarr's missing (and cutoff unmet) albums
+// on a schedule, searches Tidal for each and grabs the best match if it scores at least WANTED_MIN_SCORE. At most
+// WANTED_SYNC_MAX albums are grabbed per run. WANTED_DRY_RUN only logs what would be grabbed. Grabs go through the
+// usual queue, and LIDARR_URL's import picks them up once complete.
+
+var WantedSyncInterval time.Duration
+var WantedSyncMax int = 10
+var WantedMinScore float64 = 0.9
+var WantedDryRun bool
+var WantedCutoff bool = true
+
+// page size asked from Lidarr, and how many searches a run may send per album it's allowed to grab
+const wantedPageSize = 50
+const wantedSearchesPerGrab = 10
+
+// Lidarr album IDs grabbed by earlier runs, with the Tidal album, so they aren't searched again. After a restart the
+// history of downloads keeps them from being grabbed twice.
+var wantedGrabbed = map[int]string{}
+var wantedMutex sync.Mutex
+
+type lidarrAlbum struct {
+	Id          int    `json:"id"`
+	Title       string `json:"title"`
+	ReleaseDate string `json:"releaseDate"`
+	Artist      struct {
+		ArtistName string `json:"artistName"`
+	} `json:"artist"`
+	Releases []struct {
+		TrackCount int  `json:"trackCount"`
+		Monitored  bool `json:"monitored"`
+	} `json:"releases"`
+	Statistics struct {
+		TotalTrackCount int `json:"totalTrackCount"`
+	} `json:"statistics"`
+}
+
+type lidarrPage struct {
+	TotalRecords int           `json:"totalRecords"`
+	Records      []lidarrAlbum `json:"records"`
+}
+
+func setupWantedSync() {
+	var err error
+	WantedSyncInterval, err = time.ParseDuration(getEnv("WANTED_SYNC_INTERVAL", "0"))
+	if err != nil {
+		exitWithError("Invalid WANTED_SYNC_INTERVAL", err)
+	}
+	if WantedSyncMax, err = strconv.Atoi(getEnv("WANTED_SYNC_MAX", "10")); err != nil || WantedSyncMax < 1 {
+		exitWithError("Invalid WANTED_SYNC_MAX", errors.New("needs to be 1 or more"))
+	}
+	if WantedMinScore, err = strconv.ParseFloat(getEnv("WANTED_MIN_SCORE", "0.9"), 64); err != nil || WantedMinScore <= 0 || WantedMinScore > 1 {
+		exitWithError("Invalid WANTED_MIN_SCORE", errors.New("needs to be above 0 and at most 1"))
+	}
+	WantedDryRun = strings.EqualFold(getEnv("WANTED_DRY_RUN", "false"), "true")
+	WantedCutoff = !strings.EqualFold(getEnv("WANTED_CUTOFF", "true"), "false")
+	if WantedSyncInterval <= 0 {
+		return
+	}
+	if LidarrUrl == "" {
+		exitWithError("Invalid WANTED_SYNC_INTERVAL", errors.New("the wanted sync needs LIDARR_URL and LIDARR_API_KEY"))
+	}
+	slog.Info("Wanted sync enabled", "interval", WantedSyncInterval, "max", WantedSyncMax, "min_score", WantedMinScore, "dry_run", WantedDryRun)
+	go func() {
+		//give Lidarr a moment if both start together
+		time.Sleep(time.Minute)
+		for !stopping.Load() {
+			if _, err := syncWanted(); err != nil {
+				slog.Warn("Wanted sync failed", "error", err)
+			}
+			time.Sleep(WantedSyncInterval)
+		}
+	}()
+}
+
+// syncWanted runs once through Lidarr's wanted lists. Returns the Tidal IDs grabbed, or that would be in a dry run.
+func syncWanted() ([]string, error) {
+	start := time.Now()
+	lists := []string{"/api/v1/wanted/missing"}
+	if WantedCutoff {
+		lists = append(lists, "/api/v1/wanted/cutoff")
+	}
+	var grabbed []string
+	searches := 0
+	for _, list := range lists {
+		for page := 1; ; page++ {
+			var albums lidarrPage
+			query := url.Values{"page": {strconv.Itoa(page)}, "pageSize": {strconv.Itoa(wantedPageSize)}, "monitored": {"true"},
+				"sortKey": {"releaseDate"}, "sortDirection": {"descending"}, "includeArtist": {"true"}}
+			if err := lidarrRequest(http.MethodGet, list+"?"+query.Encode(), nil, &albums); err != nil {
+				return grabbed, fmt.Errorf("couldn't read %s: %w", list, err)
+			}
+			for _, wanted := range albums.Records {
+				if len(grabbed) >= WantedSyncMax || searches >= WantedSyncMax*wantedSearchesPerGrab || stopping.Load() {
+					slog.Info("Wanted sync finished", "grabbed", len(grabbed), "searches", searches, "duration", time.Since(start))
+					return grabbed, nil
+				}
+				if alreadyGrabbed(wanted.Id) {
+					continue
+				}
+				searches++
+				if Id, ok := grabWanted(wanted); ok {
+					grabbed = append(grabbed, Id)
+				}
+			}
+			if page*wantedPageSize >= albums.TotalRecords || len(albums.Records) == 0 {
+				break
+			}
+		}
+	}
+	slog.Info("Wanted sync finished", "grabbed", len(grabbed), "searches", searches, "duration", time.Since(start))
+	return grabbed, nil
+}
+
+// alreadyGrabbed reports whether an earlier run grabbed the album and that grab hasn't failed
+func alreadyGrabbed(lidarrId int) bool {
+	wantedMutex.Lock()
+	Id, ok := wantedGrabbed[lidarrId]
+	wantedMutex.Unlock()
+	if !ok {
+		return false
+	}
+	download, ok := getDownload(Id)
+	if !ok {
+		return false
+	}
+	DownloadsMutex.Lock()
+	defer DownloadsMutex.Unlock()
+	return download.Status != StatusFailed
+}
+
+// grabWanted searches Tidal for an album Lidarr wants and queues the best match, if it's good enough
+func grabWanted(lidarrAlbum lidarrAlbum) (string, bool) {
+	wanted := wantedAlbum{Artist: lidarrAlbum.Artist.ArtistName, Title: lidarrAlbum.Title, NumTracks: lidarrAlbum.Statistics.TotalTrackCount}
+	for _, release := range lidarrAlbum.Releases {
+		if release.Monitored && release.TrackCount > 0 {
+			wanted.NumTracks = release.TrackCount
+		}
+	}
+	if len(lidarrAlbum.ReleaseDate) >= 4 {
+		wanted.Year = lidarrAlbum.ReleaseDate[:4]
+	}
+	log := slog.With("artist", wanted.Artist, "album", wanted.Title, "lidarr_album_id", lidarrAlbum.Id)
+
+	albums, err := searchAlbums("/search/?al=" + url.QueryEscape(wanted.Artist+" "+wanted.Title))
+	if err != nil {
+		log.Warn("Wanted sync search failed", "error", err)
+		return "", false
+	}
+	var best Album
+	bestScore := 0.0
+	for _, album := range preferVersions(albums) {
+		if score := matchScore(wanted, album); score > bestScore {
+			best, bestScore = album, score
+		}
+	}
+	if bestScore < WantedMinScore {
+		log.Debug("No confident match on Tidal", "best_score", bestScore, "best", best.Artist+" - "+best.Title)
+		return "", false
+	}
+	//grabbed before a restart, or by Lidarr itself: the history still has it, and Lidarr rejecting it won't change
+	if download, ok := getDownload(best.Id); ok {
+		DownloadsMutex.Lock()
+		status := download.Status
+		DownloadsMutex.Unlock()
+		if status != StatusFailed {
+			log.Debug("Wanted album was already downloaded", "album_id", best.Id, "status", status)
+			wantedMutex.Lock()
+			wantedGrabbed[lidarrAlbum.Id] = best.Id
+			wantedMutex.Unlock()
+			return "", false
+		}
+	}
+	if WantedDryRun {
+		log.Info("Wanted sync would grab", "album_id", best.Id, "release", releaseName(best), "score", bestScore)
+		return best.Id, true
+	}
+	log.Info("Wanted sync grabbing", "album_id", best.Id, "release", releaseName(best), "score", bestScore)
+	queueDownload(sanitizeFilename(releaseName(best)), best.Id, int(best.NumTracks))
+	wantedMutex.Lock()
+	wantedGrabbed[lidarrAlbum.Id] = best.Id
+	wantedMutex.Unlock()
+	return best.Id, true
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func lidarrWanted(id int, artist string, title string, releaseDate string, tracks int) map[string]any {
+	return map[string]any{
+		"id":          id,
+		"title":       title,
+		"releaseDate": releaseDate + "T00:00:00Z",
+		"artist":      map[string]any{"artistName": artist},
+		"releases":    []map[string]any{{"trackCount": tracks + 5, "monitored": false}, {"trackCount": tracks, "monitored": true}},
+		"statistics":  map[string]any{"totalTrackCount": tracks},
+	}
+}
+
+// useWantedSync starts from an empty record of earlier runs, with the given limits
+func useWantedSync(t *testing.T, max int, dryRun bool) {
+	t.Helper()
+	oldMax, oldScore, oldDryRun, oldCutoff := WantedSyncMax, WantedMinScore, WantedDryRun, WantedCutoff
+	t.Cleanup(func() {
+		WantedSyncMax, WantedMinScore, WantedDryRun, WantedCutoff = oldMax, oldScore, oldDryRun, oldCutoff
+		wantedMutex.Lock()
+		wantedGrabbed = map[int]string{}
+		wantedMutex.Unlock()
+	})
+	WantedSyncMax, WantedMinScore, WantedDryRun, WantedCutoff = max, 0.9, dryRun, true
+	wantedMutex.Lock()
+	wantedGrabbed = map[int]string{}
+	wantedMutex.Unlock()
+}
+
+func TestMatchScore(t *testing.T) {
+	album := Album{Artist: "Beyoncé", Title: "Lemonade", NumTracks: 12, ReleaseDate: "2016-04-23"}
+	if score := matchScore(wantedAlbum{Artist: "Beyonce", Title: "LEMONADE!", NumTracks: 12, Year: "2016"}, album); score < 0.99 {
+		t.Errorf("the same album should match fully, got %v", score)
+	}
+	if score := matchScore(wantedAlbum{Artist: "Beyonce", Title: "Lemonade", NumTracks: 20, Year: "2019"}, album); score > 0.85 {
+		t.Errorf("another edition shouldn't be confident, got %v", score)
+	}
+	if score := matchScore(wantedAlbum{Artist: "Lemonade Kids", Title: "Lemonade", NumTracks: 12, Year: "2016"}, album); score > 0.85 {
+		t.Errorf("another artist shouldn't match, got %v", score)
+	}
+	if normalizeName("Simon & Garfunkel – Bookends") != "simon and garfunkel bookends" {
+		t.Errorf("unexpected normalization %q", normalizeName("Simon & Garfunkel – Bookends"))
+	}
+}
+
+func TestWantedSyncGrabsConfidentMatches(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	lidarr := useLidarr(t, true)
+	useWantedSync(t, 10, false)
+	lidarr.wanted["missing"] = []map[string]any{
+		lidarrWanted(1, "The Testers", "Green Bar", "2021-03-05", 2),
+		// on Tidal, but Lidarr wants a different release
+		lidarrWanted(2, "The Testers", "Red Bar", "2012-01-01", 9),
+		lidarrWanted(3, "The Testers", "Blue Bar", "2020-01-01", 3),
+	}
+	lidarr.wanted["cutoff"] = []map[string]any{lidarrWanted(4, "The Testers", "Red Bar", "2019-11-01", 1)}
+
+	grabbed, err := syncWanted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grabbed) != 2 || grabbed[0] != "1001" || grabbed[1] != "1002" {
+		t.Fatalf("expected Green Bar and the cutoff's Red Bar, got %v", grabbed)
+	}
+	for _, nzoId := range []string{"SABnzbd_nzo_1001", "SABnzbd_nzo_1002"} {
+		if slot := waitForImport(t, proxy, nzoId); slot.Status != "Completed" {
+			t.Errorf("grab didn't complete: %+v", slot)
+		}
+	}
+
+	// a second run leaves albums that are already grabbed alone
+	if grabbed, _ := syncWanted(); len(grabbed) != 0 {
+		t.Errorf("albums grabbed twice: %v", grabbed)
+	}
+}
+
+func TestWantedSyncDryRunAndLimit(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	lidarr := useLidarr(t, true)
+	useWantedSync(t, 1, true)
+	lidarr.wanted["missing"] = []map[string]any{
+		lidarrWanted(1, "The Testers", "Green Bar", "2021-03-05", 2),
+		lidarrWanted(2, "The Testers", "Red Bar", "2019-11-01", 1),
+	}
+	grabbed, err := syncWanted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grabbed) != 1 {
+		t.Errorf("expected one album within the limit, got %v", grabbed)
+	}
+	if queue := proxy.queue(t); len(queue.Queue.Slots) != 0 || len(listDownloads()) != 0 {
+		t.Errorf("a dry run shouldn't grab anything, queue %+v", queue.Queue.Slots)
+	}
+}
+
+func TestWantedSyncAfterRestartSkipsRejectedAlbum(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	lidarr := useLidarr(t, false)
+	useWantedSync(t, 10, false)
+	lidarr.wanted["missing"] = []map[string]any{lidarrWanted(1, "The Testers", "Green Bar", "2021-03-05", 2)}
+	if grabbed, _ := syncWanted(); len(grabbed) != 1 {
+		t.Fatalf("expected Green Bar grabbed, got %v", grabbed)
+	}
+	waitForImport(t, proxy, "SABnzbd_nzo_1001")
+
+	// Lidarr rejected it, so it's still wanted after a restart
+	restart(t)
+	wantedMutex.Lock()
+	wantedGrabbed = map[int]string{}
+	wantedMutex.Unlock()
+	if grabbed, _ := syncWanted(); len(grabbed) != 0 {
+		t.Errorf("album in the history grabbed again: %v", grabbed)
+	}
+	if download, _ := getDownload("1001"); download.Status != StatusCompleted {
+		t.Errorf("history entry was replaced: %+v", download)
+	}
+}
+
+func TestWantedSyncSanitizesFolderName(t *testing.T) {
+	track := []fakeTrack{{Id: 91, Title: "One", TrackNumber: 1, VolumeNumber: 1, Duration: 1}}
+	proxy := newTestProxy(t, "flac", fakeAlbum{Id: "6001", Artist: "AC/DC", Title: "Slash Bar", ReleaseDate: "2021-03-05", Tracks: track})
+	lidarr := useLidarr(t, false)
+	useWantedSync(t, 10, false)
+	lidarr.wanted["missing"] = []map[string]any{lidarrWanted(1, "AC/DC", "Slash Bar", "2021-03-05", 1)}
+	if grabbed, _ := syncWanted(); len(grabbed) != 1 {
+		t.Fatalf("expected Slash Bar grabbed, got %v", grabbed)
+	}
+	slot := waitForImport(t, proxy, "SABnzbd_nzo_6001")
+	if slot.Name != "AC_DC-Slash Bar-16BIT-44-KHZ-WEB-FLAC-2021-TIDLARR" || filepath.Dir(slot.Storage) != filepath.Join(DownloadPath, "complete", Category) {
+		t.Errorf("expected a single folder without the slash, got %s in %s", slot.Name, slot.Storage)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Every target in WEBHOOK_URLS gets a JSON POST when a grab is added, starts, completes or fails. WEBHOOK_TEMPLATE
+// replaces the payload for services with a fixed schema, e.g. Discord's {"content": {{json .Album}}}, where json
+// quotes a field so names with quotes still make valid JSON.
+// Each target has its own queue, so events arrive in order and a slow one doesn't hold up the others. Failed
+// deliveries are retried WEBHOOK_RETRIES times, waiting twice as long each time.
+
+const (
+	EventAdded     = "added"
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventFailed    = "failed"
+)
+
+var webhookTargets []*webhookTarget
+var WebhookEvents = map[string]bool{EventAdded: true, EventStarted: true, EventCompleted: true, EventFailed: true}
+var WebhookTemplate *template.Template
+var WebhookRetries int = 3
+var webhookBackoff = 2 * time.Second
+
+type WebhookPayload struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	NzoId   string    `json:"nzo_id"`
+	AlbumId string    `json:"tidal_album_id"`
+	Artist  string    `json:"artist"`
+	Album   string    `json:"album"`
+	Name    string    `json:"name"`
+	Quality string    `json:"quality"`
+	Tracks  int       `json:"tracks"`
+	// bytes on disk, once completed
+	Size int64 `json:"size"`
+	// running time of the album in seconds
+	Duration int `json:"duration"`
+	// seconds the download took
+	DownloadTime int    `json:"download_time"`
+	Path         string `json:"path"`
+	Error        string `json:"error"`
+}
+
+// webhook URLs often carry a token, so only their host is ever logged
+type webhookTarget struct {
+	url   string
+	queue chan WebhookPayload
+}
+
+func setupWebhooks() {
+	if events := getEnv("WEBHOOK_EVENTS", ""); events != "" {
+		WebhookEvents = map[string]bool{}
+		for _, event := range strings.Split(events, ",") {
+			event = strings.ToLower(strings.TrimSpace(event))
+			if event != EventAdded && event != EventStarted && event != EventCompleted && event != EventFailed {
+				exitWithError("Invalid WEBHOOK_EVENTS", fmt.Errorf("unknown event %q, use added, started, completed or failed", event))
+			}
+			WebhookEvents[event] = true
+		}
+	}
+	var err error
+	WebhookRetries, err = strconv.Atoi(getEnv("WEBHOOK_RETRIES", "3"))
+	if err != nil || WebhookRetries < 0 {
+		exitWithError("Invalid WEBHOOK_RETRIES", fmt.Errorf("%q isn't a number of retries", getEnv("WEBHOOK_RETRIES", "3")))
+	}
+	if text := getEnv("WEBHOOK_TEMPLATE", ""); text != "" {
+		if WebhookTemplate, err = parseWebhookTemplate(text); err != nil {
+			exitWithError("Invalid WEBHOOK_TEMPLATE", err)
+		}
+	}
+	for _, link := range strings.Split(getEnv("WEBHOOK_URLS", ""), ",") {
+		if link = strings.TrimSpace(link); link != "" {
+			webhookTargets = append(webhookTargets, newWebhookTarget(link))
+		}
+	}
+	if len(webhookTargets) > 0 {
+		slog.Info("Webhooks enabled", "targets", len(webhookTargets))
+	}
+}
+
+// parseWebhookTemplate reads a payload template. {{json .Field}} quotes a value for use in JSON.
+func parseWebhookTemplate(text string) (*template.Template, error) {
+	return template.New("webhook").Funcs(template.FuncMap{
+		"json": func(value any) (string, error) {
+			data, err := json.Marshal(value)
+			return string(data), err
+		},
+	}).Option("missingkey=error").Parse(text)
+}
+
+// newWebhookTarget starts delivering to link
+func newWebhookTarget(link string) *webhookTarget {
+	target := &webhookTarget{url: link, queue: make(chan WebhookPayload, 100)}
+	go func() {
+		for payload := range target.queue {
+			target.deliver(payload)
+		}
+	}()
+	return target
+}
+
+// notify queues an event for every target. A job still running has no duration yet, pass 0.
+func notify(event string, download *Download, elapsed time.Duration) {
+	if len(webhookTargets) == 0 || !WebhookEvents[event] {
+		return
+	}
+	DownloadsMutex.Lock()
+	payload := WebhookPayload{
+		Event:        event,
+		Time:         time.Now(),
+		NzoId:        "SABnzbd_nzo_" + download.Id,
+		AlbumId:      download.Id,
+		Artist:       download.Artist,
+		Album:        download.Album,
+		Name:         download.FileName,
+		Quality:      outputQuality(),
+		Tracks:       download.numTracks,
+		DownloadTime: int(elapsed.Seconds()),
+		Error:        download.FailMessage,
+	}
+	for _, track := range download.Files {
+		payload.Duration += track.duration
+	}
+	DownloadsMutex.Unlock()
+	if event == EventCompleted {
+		payload.Path = filepath.Join(DownloadPath, "complete", Category, payload.Name)
+		payload.Size, _ = folderSize(payload.Path)
+	}
+	for _, target := range webhookTargets {
+		select {
+		case target.queue <- payload:
+		default:
+			slog.Warn("Webhook queue is full, dropping event", "target", mirrorLabel(target.url), "event", event, "nzo_id", payload.NzoId)
+		}
+	}
+}
+
+func (target *webhookTarget) deliver(payload WebhookPayload) {
+	var body bytes.Buffer
+	if WebhookTemplate != nil {
+		if err := WebhookTemplate.Execute(&body, payload); err != nil {
+			slog.Error("Couldn't render webhook template", "event", payload.Event, "error", err)
+			return
+		}
+	} else if err := json.NewEncoder(&body).Encode(payload); err != nil {
+		slog.Error("Couldn't encode webhook payload", "event", payload.Event, "error", err)
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	wait := webhookBackoff
+	for attempt := 0; ; attempt++ {
+		err := postWebhook(client, target.url, body.Bytes())
+		if err == nil {
+			slog.Debug("Webhook delivered", "target", mirrorLabel(target.url), "event", payload.Event, "nzo_id", payload.NzoId)
+			return
+		}
+		if attempt >= WebhookRetries {
+			slog.Warn("Webhook delivery failed, giving up", "target", mirrorLabel(target.url), "event", payload.Event, "nzo_id", payload.NzoId, "attempts", attempt+1, "error", err)
+			return
+		}
+		slog.Debug("Webhook delivery failed, retrying", "target", mirrorLabel(target.url), "event", payload.Event, "retry_in", wait, "error", err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func postWebhook(client *http.Client, link string, body []byte) error {
+	resp, err := client.Post(link, "application/json", bytes.NewReader(body))
+	if err != nil {
+		//the error would repeat the URL
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useWebhook points the webhooks at a receiver and returns what it gets. The receiver fails the first failures
+// requests.
+func useWebhook(t *testing.T, template string, failures int32) chan string {
+	t.Helper()
+	received := make(chan string, 20)
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	t.Cleanup(receiver.Close)
+
+	oldTargets, oldTemplate, oldBackoff, oldRetries := webhookTargets, WebhookTemplate, webhookBackoff, WebhookRetries
+	target := newWebhookTarget(receiver.URL + "/hook?token=secret")
+	t.Cleanup(func() {
+		close(target.queue)
+		webhookTargets, WebhookTemplate, webhookBackoff, WebhookRetries = oldTargets, oldTemplate, oldBackoff, oldRetries
+	})
+	webhookTargets = []*webhookTarget{target}
+	webhookBackoff = 10 * time.Millisecond
+	WebhookRetries = 3
+	WebhookTemplate = nil
+	if template != "" {
+		var err error
+		if WebhookTemplate, err = parseWebhookTemplate(template); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return received
+}
+
+func nextWebhook(t *testing.T, received chan string) string {
+	t.Helper()
+	select {
+	case body := <-received:
+		return body
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook arrived")
+		return ""
+	}
+}
+
+func TestWebhooksFollowTheJob(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	received := useWebhook(t, "", 0)
+	item := findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Green Bar"}}), "Green Bar")
+	nzoId := proxy.grab(t, item)
+	proxy.waitForHistory(t, nzoId)
+
+	var events []WebhookPayload
+	for i := 0; i < 3; i++ {
+		var payload WebhookPayload
+		if err := json.Unmarshal([]byte(nextWebhook(t, received)), &payload); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, payload)
+	}
+	if events[0].Event != EventAdded || events[1].Event != EventStarted || events[2].Event != EventCompleted {
+		t.Fatalf("events out of order: %+v", events)
+	}
+	completed := events[2]
+	if completed.NzoId != nzoId || completed.AlbumId != "1001" || completed.Artist != "The Testers" || completed.Album != "Green Bar" ||
+		completed.Tracks != 2 || completed.Duration != 2 || completed.Quality != "LOSSLESS" {
+		t.Errorf("unexpected completed event %+v", completed)
+	}
+	if completed.Size == 0 || !strings.HasSuffix(completed.Path, item.Title) || completed.Error != "" {
+		t.Errorf("completed event should carry the final folder and its size, got %+v", completed)
+	}
+}
+
+func TestWebhookForFailedJob(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	received := useWebhook(t, "", 0)
+	WebhookEvents = map[string]bool{EventFailed: true}
+	t.Cleanup(func() {
+		WebhookEvents = map[string]bool{EventAdded: true, EventStarted: true, EventCompleted: true, EventFailed: true}
+	})
+	proxy.Upstream.Corrupt(100)
+	proxy.waitForHistory(t, proxy.grab(t, findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Red Bar"}}), "Red Bar")))
+
+	var payload WebhookPayload
+	json.Unmarshal([]byte(nextWebhook(t, received)), &payload)
+	if payload.Event != EventFailed || !strings.Contains(payload.Error, "failed verification") {
+		t.Errorf("expected only the failure, got %+v", payload)
+	}
+}
+
+func TestWebhookTemplateAndRetries(t *testing.T) {
+	proxy := newTestProxy(t, "flac")
+	received := useWebhook(t, `{"content": {{json (printf "%s - %s %s" .Artist .Album .Event)}}}`, 2)
+	WebhookEvents = map[string]bool{EventCompleted: true}
+	t.Cleanup(func() {
+		WebhookEvents = map[string]bool{EventAdded: true, EventStarted: true, EventCompleted: true, EventFailed: true}
+	})
+	proxy.waitForHistory(t, proxy.grab(t, findItem(t, proxy.search(t, url.Values{"t": {"search"}, "q": {"Red Bar"}}), "Red Bar")))
+
+	if body := nextWebhook(t, received); body != `{"content": "The Testers - Red Bar completed"}` {
+		t.Errorf("unexpected templated payload %s", body)
+	}
+}
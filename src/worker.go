@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SABnzbd job states, as Lidarr understands them
+const (
+	StatusQueued      = "Queued"
+	StatusFetching    = "Fetching"
+	StatusDownloading = "Downloading"
+	StatusPaused      = "Paused"
+	StatusRunning     = "Running"
+	StatusCompleted   = "Completed"
+	StatusFailed      = "Failed"
+)
+
+var DownloadWorkers int = 2
+
+// DownloadsMutex guards Downloads and the fields of every Download in it
+var DownloadsMutex sync.Mutex
+var jobs = make(chan string, 10000)
+var startWorkersOnce sync.Once
+
+func setupWorkers() {
+	DownloadWorkers, _ = strconv.Atoi(getEnv("DOWNLOAD_WORKERS", "2"))
+	if DownloadWorkers < 1 {
+		DownloadWorkers = 1
+	}
+}
+
+// queueDownload registers a grab and hands it to the workers. Nothing is requested from upstream yet,
+// so the grab can be acknowledged right away.
+func queueDownload(filename string, Id string, numTracks int) {
+	DownloadsMutex.Lock()
+	if download, ok := Downloads[Id]; ok && download.Status != StatusCompleted && download.Status != StatusFailed {
+		DownloadsMutex.Unlock()
+		slog.Info("Download is already queued", "nzo_id", "SABnzbd_nzo_"+Id, "album_id", Id)
+		return
+	}
+	download := &Download{
+		Id:        Id,
+		FileName:  filename,
+		numTracks: numTracks,
+		hasLyrics: true,
+		Status:    StatusQueued,
+		added:     time.Now(),
+	}
+	Downloads[Id] = download
+	DownloadsMutex.Unlock()
+	albumsQueuedTotal.inc()
+	notify(EventAdded, download, 0)
+	enqueue(Id)
+}
+
+// enqueue hands a registered download to the workers
+func enqueue(Id string) {
+	startWorkersOnce.Do(func() {
+		for i := 0; i < DownloadWorkers; i++ {
+			go worker()
+		}
+	})
+	jobs <- Id
+}
+
+func worker() {
+	for Id := range jobs {
+		runJob(Id)
+	}
+}
+
+func runJob(Id string) {
+	//counted before checking stopping, so drainWorkers can't miss a job that's just starting
+	activeJobs.Add(1)
+	defer activeJobs.Add(-1)
+	download, ok := getDownload(Id)
+	if !ok || stopping.Load() {
+		//deleted while it was waiting in the queue, or left for the checkpoint
+		return
+	}
+	log := slog.With("nzo_id", "SABnzbd_nzo_"+Id, "album_id", Id)
+	start := time.Now()
+	log.Info("Starting download")
+	setStatus(download, StatusFetching)
+	err := fetchAlbum(download)
+	if err == nil {
+		err = waitForDiskSpace(download, albumSize(*download))
+	}
+	if err == nil {
+		setStatus(download, StatusDownloading)
+		err = startDownload(Id)
+	}
+	if errors.Is(err, errInterrupted) {
+		log.Info("Download interrupted, it will resume on the next start", "duration", time.Since(start))
+		setStatus(download, StatusQueued)
+		return
+	}
+	if err != nil {
+		log.Error("Download failed", "duration", time.Since(start), "error", err)
+		addWarning("SABnzbd_nzo_"+Id, "Download of "+download.FileName+" failed: "+err.Error())
+		DownloadsMutex.Lock()
+		download.FailMessage = err.Error()
+		DownloadsMutex.Unlock()
+		postProcess(download, filepath.Join(DownloadPath, "incomplete", Category, download.FileName), true)
+		albumsFailedTotal.inc()
+		setStatus(download, StatusFailed)
+		notify(EventFailed, download, time.Since(start))
+		return
+	}
+	forgetCompleteSize()
+	if err := postProcess(download, filepath.Join(DownloadPath, "complete", Category, download.FileName), false); err != nil {
+		log.Error("Post-processing script failed", "duration", time.Since(start), "error", err)
+		addWarning("SABnzbd_nzo_"+Id, "Post-processing of "+download.FileName+" failed: "+err.Error())
+		DownloadsMutex.Lock()
+		download.FailMessage = err.Error()
+		DownloadsMutex.Unlock()
+		albumsFailedTotal.inc()
+		setStatus(download, StatusFailed)
+		notify(EventFailed, download, time.Since(start))
+		return
+	}
+	if LidarrUrl == "" {
+		completeJob(download, log, start)
+		return
+	}
+	//Lidarr's own completed download handling would import the folder at the same time as the scan, so the job
+	//only shows as completed once the import is done
+	setImportStatus(download, ImportRunning, "")
+	setStatus(download, StatusRunning)
+	go func() {
+		triggerImport(download)
+		completeJob(download, log, start)
+	}()
+}
+
+func completeJob(download *Download, log *slog.Logger, start time.Time) {
+	setStatus(download, StatusCompleted)
+	albumsCompletedTotal.inc()
+	log.Info("Download completed", "duration", time.Since(start))
+	notify(EventCompleted, download, time.Since(start))
+}
+
+// postProcess runs the scripts for a finished job, showing it as Running meanwhile, and keeps their output
+func postProcess(download *Download, folder string, failed bool) error {
+	if len(Scripts) == 0 {
+		return nil
+	}
+	setStatus(download, StatusRunning)
+	DownloadsMutex.Lock()
+	job := *download
+	DownloadsMutex.Unlock()
+	scriptLog, err := runScripts(job, folder, failed)
+	DownloadsMutex.Lock()
+	download.scriptLog = scriptLog
+	DownloadsMutex.Unlock()
+	//kept for the history after a restart, failed jobs aren't restored
+	if !failed {
+		if err := updateManifest(folder, func(manifest *AlbumManifest) { manifest.ScriptLog = scriptLog }); err != nil {
+			slog.Warn("Couldn't save the script output in the album manifest", "nzo_id", "SABnzbd_nzo_"+job.Id, "error", err)
+		}
+	}
+	return err
+}
+
+func getDownload(Id string) (*Download, bool) {
+	DownloadsMutex.Lock()
+	defer DownloadsMutex.Unlock()
+	download, ok := Downloads[Id]
+	return download, ok
+}
+
+func setStatus(download *Download, status string) {
+	DownloadsMutex.Lock()
+	defer DownloadsMutex.Unlock()
+	download.Status = status
+}
+
+// listDownloads returns a snapshot of all downloads, oldest first
+func listDownloads() []Download {
+	DownloadsMutex.Lock()
+	list := make([]Download, 0, len(Downloads))
+	for _, download := range Downloads {
+		list = append(list, *download)
+	}
+	DownloadsMutex.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].added.Equal(list[j].added) {
+			return list[i].FileName < list[j].FileName
+		}
+		return list[i].added.Before(list[j].added)
+	})
+	return list
+}